@@ -4,8 +4,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	device "github.com/neomantra/nomad-device-onload/internal/onload_device"
 	"github.com/spf13/pflag"
@@ -15,38 +19,133 @@ func main() {
 
 	var showHelp bool
 	var onloadDir string
+	var moduleParams []string
+	var timeout time.Duration
+	var drainDir string
 
-	pflag.StringVarP(&onloadDir, "dir", "d", "/usr/bin", "Directory holding the onload executable")
+	pflag.StringVarP(&onloadDir, "dir", "d", "/usr/bin", "Directory holding the onload executable, or 'auto' to discover it")
+	pflag.StringSliceVarP(&moduleParams, "param", "p", []string{"onload/*", "sfc_resource/*", "sfc_char/*"}, "Kernel module parameters to show, as <module>/<parameter> globs")
+	pflag.DurationVarP(&timeout, "timeout", "t", 10*time.Second, "Timeout of each probe command")
+	pflag.StringVar(&drainDir, "drain-dir", "/etc/nomad-onload/drain", "Directory of operator drain files, per the plugin's drain_dir")
 	pflag.BoolVar(&showHelp, "help", false, "Show help")
 	pflag.Parse()
 
 	if showHelp {
-		fmt.Fprintf(os.Stdout, "usage: %s\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "usage: %s [drain <iface> [reason] | undrain <iface> | drained]\n", os.Args[0])
 		pflag.PrintDefaults()
 		os.Exit(0)
 	}
 
-	ooVersion, err := device.ProbeOnloadVersion(onloadDir)
+	// Drain subcommands
+	switch pflag.Arg(0) {
+	case "":
+		// probe, below
+	case "drain":
+		if pflag.NArg() < 2 {
+			fmt.Fprintf(os.Stderr, "usage: %s drain <iface> [reason]\n", os.Args[0])
+			os.Exit(1)
+		}
+		reason := strings.Join(pflag.Args()[2:], " ")
+		if err := device.DrainInterface(drainDir, pflag.Arg(1), reason); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to drain: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "Drained %s\n", pflag.Arg(1))
+		os.Exit(0)
+	case "undrain":
+		if pflag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "usage: %s undrain <iface>\n", os.Args[0])
+			os.Exit(1)
+		}
+		if err := device.UndrainInterface(drainDir, pflag.Arg(1)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to undrain: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "Undrained %s\n", pflag.Arg(1))
+		os.Exit(0)
+	case "drained":
+		drained, err := device.ProbeDrainedInterfaces(drainDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to query drained interfaces: %s\n", err.Error())
+			os.Exit(1)
+		}
+		ifaces := make([]string, 0, len(drained))
+		for iface := range drained {
+			ifaces = append(ifaces, iface)
+		}
+		sort.Strings(ifaces)
+		for _, iface := range ifaces {
+			fmt.Fprintf(os.Stdout, "%-8s %s\n", iface, drained[iface])
+		}
+		os.Exit(0)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", pflag.Arg(0))
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	layout := device.ProbeHostLayout(ctx)
+	cancel()
+	fmt.Fprintf(os.Stdout, "Host layout:\n")
+	fmt.Fprintf(os.Stdout, "  %-24s %s\n", "onload_lib_path", layout.OnloadLibPath)
+	fmt.Fprintf(os.Stdout, "  %-24s %s\n", "onload_bin_path", layout.OnloadBinPath)
+	fmt.Fprintf(os.Stdout, "  %-24s %s\n", "onload_profile_dir_path", layout.ProfileDirPath)
+	fmt.Fprintf(os.Stdout, "  %-24s %s\n", "zf_lib_path", layout.ZfLibPath)
+	fmt.Fprintf(os.Stdout, "  %-24s %s\n", "zf_bin_path", layout.ZfBinPath)
+	zfDir := onloadDir
+	if onloadDir == "auto" {
+		onloadDir, zfDir = layout.OnloadBinPath, layout.ZfBinPath
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	ooVersion, err := device.ProbeOnloadVersion(ctx, onloadDir)
+	cancel()
 	if err != nil {
 		fmt.Fprintf(os.Stdout, "Onload version: not found (err: %s)\n", err.Error())
 	} else {
 		fmt.Fprintf(os.Stdout, "Onload version: %s\n", ooVersion)
 	}
 
-	zfVersion, err := device.ProbeZFVersion(onloadDir)
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	zfVersion, err := device.ProbeZFVersion(ctx, zfDir)
+	cancel()
 	if err != nil {
 		fmt.Fprintf(os.Stdout, "TCPDirect version: not found (err: %s)\n", err.Error())
 	} else {
 		fmt.Fprintf(os.Stdout, "TCPDirect version: %s\n", zfVersion)
 	}
 
+	if layout.ProfileDirPath != "" {
+		if profiles, err := device.ProbeOnloadProfiles(layout.ProfileDirPath); err != nil {
+			fmt.Fprintf(os.Stdout, "Onload profiles: not found (err: %s)\n", err.Error())
+		} else {
+			fmt.Fprintf(os.Stdout, "Onload profiles: %s\n", strings.Join(profiles, ", "))
+		}
+	}
+
+	fmt.Fprintf(os.Stdout, "Kernel module parameters:\n")
+	if params, err := device.ProbeModuleParameters(moduleParams); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query kernel module parameters: %s\n", err.Error())
+	} else {
+		names := make([]string, 0, len(params))
+		for name := range params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stdout, "  %-40s %s\n", name, params[name])
+		}
+	}
+
 	fmt.Fprintf(os.Stdout, "Onload hardware-accelerated interfaces:\n")
-	sfcNics, err := device.ProbeOnloadSFCNics()
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	sfcNics, err := device.ProbeOnloadSFCNics(ctx)
+	cancel()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to query SFC interfaces: %s\n", err.Error())
 	} else {
 		for _, nic := range sfcNics {
-			fmt.Fprintf(os.Stdout, "  %-8s %s\n", nic.Interface, nic.PCIBusID)
+			fmt.Fprintf(os.Stdout, "  %-8s %s %s\n", nic.Interface, nic.PCIBusID, nic.MACAddress)
 		}
 	}
 
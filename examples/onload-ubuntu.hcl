@@ -9,5 +9,8 @@ config {
   host_zf_lib_path     = "/usr/lib/x86_64-linux-gnu/"
   host_zf_bin_path     = "/usr/bin"
 
+  # Alternatively, "auto" discovers each of these paths, on any distribution:
+  #   host_onload_lib_path = "auto"
+
   mount_onload = true
 }
\ No newline at end of file
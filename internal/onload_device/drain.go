@@ -0,0 +1,108 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Operators may drain an interface, such as for NIC firmware updates or cable work,
+// by creating a file named after it in the drain directory (`drain_dir`).
+// That interface's pseudo-devices are then marked unhealthy, stopping new placements
+// without touching the rest of the host.  The file's contents, if any, are the reason.
+//
+// The drain directory is watched, so draining and undraining take effect immediately.
+
+// healthDesc_Drained is the health description of drained devices
+const healthDesc_Drained = "drained by operator"
+
+// validateDrainInterface returns an error if iface cannot name a drain file
+func validateDrainInterface(iface string) error {
+	if iface == "" || iface == "." || iface == ".." || strings.ContainsRune(iface, filepath.Separator) {
+		return fmt.Errorf("invalid interface name '%s'", iface)
+	}
+	return nil
+}
+
+// DrainInterface drains the interface iface by creating its file in drainDir,
+// with an optional reason
+func DrainInterface(drainDir string, iface string, reason string) error {
+	if err := validateDrainInterface(iface); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(drainDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create drain directory '%s': %w", drainDir, err)
+	}
+	drainPath := filepath.Join(drainDir, iface)
+	if err := os.WriteFile(drainPath, []byte(reason), 0o644); err != nil {
+		return fmt.Errorf("failed to drain '%s': %w", iface, err)
+	}
+	return nil
+}
+
+// UndrainInterface undrains the interface iface by removing its file from drainDir.
+// Undraining an interface that is not drained is not an error.
+func UndrainInterface(drainDir string, iface string) error {
+	if err := validateDrainInterface(iface); err != nil {
+		return err
+	}
+	drainPath := filepath.Join(drainDir, iface)
+	if err := os.Remove(drainPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to undrain '%s': %w", iface, err)
+	}
+	return nil
+}
+
+// ProbeDrainedInterfaces returns the interfaces drained in drainDir, mapped to their reasons.
+// A missing drain directory means no interfaces are drained.
+func ProbeDrainedInterfaces(drainDir string) (map[string]string, error) {
+	drained := make(map[string]string)
+	if drainDir == "" {
+		return drained, nil
+	}
+	entries, err := os.ReadDir(drainDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return drained, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		reasonBytes, err := os.ReadFile(filepath.Join(drainDir, entry.Name()))
+		if err != nil {
+			continue // removed while reading
+		}
+		drained[entry.Name()] = strings.TrimSpace(string(reasonBytes))
+	}
+	return drained, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// applyOperatorDrain marks the devices of interfaces drained in drainDir as unhealthy
+func (d *OnloadDevicePlugin) applyOperatorDrain(allDevices []*FingerprintDeviceData, drainDir string) {
+	drained, err := ProbeDrainedInterfaces(drainDir)
+	if err != nil {
+		d.logger.Warn("Issue probing drained interfaces", "err", err.Error())
+		return
+	}
+	for _, device := range allDevices {
+		reason, ok := drained[device.Interface]
+		if !ok {
+			continue
+		}
+		device.Healthy = false
+		device.HealthDesc = healthDesc_Drained
+		if reason != "" {
+			device.HealthDesc += ": " + reason
+		}
+	}
+}
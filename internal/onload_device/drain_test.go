@@ -0,0 +1,121 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+func TestDrainInterface(t *testing.T) {
+	drainDir := filepath.Join(t.TempDir(), "drain")
+
+	// the drain directory is created by the first drain
+	if err := DrainInterface(drainDir, "eth0", "firmware update"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DrainInterface(drainDir, "eth1", ""); err != nil {
+		t.Fatal(err)
+	}
+	drained, err := ProbeDrainedInterfaces(drainDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"eth0": "firmware update", "eth1": ""}; !reflect.DeepEqual(drained, want) {
+		t.Errorf("drained = %v, want %v", drained, want)
+	}
+
+	// undraining twice is not an error
+	for i := 0; i < 2; i++ {
+		if err := UndrainInterface(drainDir, "eth0"); err != nil {
+			t.Errorf("undrain %d = %v", i, err)
+		}
+	}
+	drained, err = ProbeDrainedInterfaces(drainDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"eth1": ""}; !reflect.DeepEqual(drained, want) {
+		t.Errorf("drained after undrain = %v, want %v", drained, want)
+	}
+
+	// names that cannot be a file in the drain directory are rejected
+	for _, iface := range []string{"", ".", "..", "../eth0", "eth0/1"} {
+		if err := DrainInterface(drainDir, iface, ""); err == nil {
+			t.Errorf("DrainInterface(%q) succeeded, want an error", iface)
+		}
+		if err := UndrainInterface(drainDir, iface); err == nil {
+			t.Errorf("UndrainInterface(%q) succeeded, want an error", iface)
+		}
+	}
+}
+
+func TestProbeDrainedInterfaces(t *testing.T) {
+	dir := t.TempDir()
+
+	// no drain directory, or a missing one, drains nothing
+	for _, drainDir := range []string{"", filepath.Join(dir, "missing")} {
+		drained, err := ProbeDrainedInterfaces(drainDir)
+		if err != nil || len(drained) != 0 {
+			t.Errorf("ProbeDrainedInterfaces(%q) = %v, %v, want none", drainDir, drained, err)
+		}
+	}
+
+	// hidden files, such as editor swap files, and directories are not drains;
+	// reasons are trimmed
+	files := map[string]string{"eth0": "  cable work\n", ".eth1.swp": "", "ens1f0": ""}
+	for name, reason := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(reason), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "eth2"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	drained, err := ProbeDrainedInterfaces(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"eth0": "cable work", "ens1f0": ""}; !reflect.DeepEqual(drained, want) {
+		t.Errorf("drained = %v, want %v", drained, want)
+	}
+}
+
+func TestApplyOperatorDrain(t *testing.T) {
+	drainDir := t.TempDir()
+	if err := DrainInterface(drainDir, "eth0", "cable work"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DrainInterface(drainDir, "eth1", ""); err != nil {
+		t.Fatal(err)
+	}
+	devices := []*FingerprintDeviceData{
+		{ID: "eth0-0", Interface: "eth0", DeviceType: deviceType_Onload, Healthy: true},
+		{ID: "eth0-1", Interface: "eth0", DeviceType: deviceType_Onload, Healthy: true},
+		{ID: "eth1-0", Interface: "eth1", DeviceType: deviceType_PTP, Healthy: true},
+		{ID: "eth2-0", Interface: "eth2", DeviceType: deviceType_Onload, Healthy: true},
+	}
+
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	d.applyOperatorDrain(devices, drainDir)
+	want := []struct {
+		healthy    bool
+		healthDesc string
+	}{
+		{false, healthDesc_Drained + ": cable work"},
+		{false, healthDesc_Drained + ": cable work"},
+		{false, healthDesc_Drained},
+		{true, ""},
+	}
+	for i, device := range devices {
+		if device.Healthy != want[i].healthy || device.HealthDesc != want[i].healthDesc {
+			t.Errorf("%s healthy %v %q, want %v %q", device.ID,
+				device.Healthy, device.HealthDesc, want[i].healthy, want[i].healthDesc)
+		}
+	}
+}
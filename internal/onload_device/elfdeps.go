@@ -0,0 +1,163 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The shared libraries needed by the mounted Onload and TCPDirect binaries and libraries,
+// like `libpcap` for `onload_stackdump`, differ across distributions and Onload builds.
+// So rather than hard-coding them, their dependency closure is computed from their ELF
+// `DT_NEEDED` entries and mounted too, except for those the Task image is expected to provide.
+
+// elfDefaultLibDirs are searched for libraries after RUNPATH, the Host library path and the linker cache
+var elfDefaultLibDirs = append([]string{"/lib64", "/lib/x86_64-linux-gnu", "/lib/aarch64-linux-gnu", "/usr/lib", "/lib"}, layoutLibDirs...)
+
+// maxSymlinkHops limits following symlink chains, in case of loops
+const maxSymlinkHops = 40
+
+// elfResolver resolves the shared library dependencies of ELF files against the Host
+type elfResolver struct {
+	searchDirs  []string          // directories searched for libraries, after RUNPATH and the linker cache
+	linkerCache map[string]string // library names to paths, per `ldconfig -p`
+	exclude     []string          // globs of library names which are not resolved, as Tasks provide them
+}
+
+// elfIdent is the class and machine of an ELF file, which its libraries must match
+type elfIdent struct {
+	class   elf.Class
+	machine elf.Machine
+}
+
+// closure returns the Host paths of the libraries needed by roots, transitively,
+// including the symlinks from each library's soname to its file, and the files
+// symlinked roots lead to, like `libonload.so.1` for `libonload.so`, but not roots themselves.
+// Files which are not ELF are skipped.  Libraries which are not found are returned as missing.
+func (r *elfResolver) closure(roots []string) (deps []string, missing []string) {
+	seenPaths := make(map[string]bool)
+	seenNames := make(map[string]bool)
+	addPath := func(path string) {
+		for _, link := range symlinkChain(path) {
+			if !seenPaths[link] {
+				seenPaths[link] = true
+				deps = append(deps, link)
+			}
+		}
+	}
+
+	queue := append([]string{}, roots...)
+	for _, root := range roots {
+		seenPaths[root] = true
+	}
+	for _, root := range roots {
+		addPath(root)
+	}
+	for len(queue) != 0 {
+		path := queue[0]
+		queue = queue[1:]
+
+		needed, runPaths, ident, ok := readELFDynamic(path)
+		if !ok {
+			continue
+		}
+		for _, libName := range needed {
+			if seenNames[libName] || r.isExcluded(libName) {
+				continue
+			}
+			seenNames[libName] = true
+			libPath := r.find(libName, runPaths, ident)
+			if libPath == "" {
+				missing = append(missing, libName)
+				continue
+			}
+			addPath(libPath)
+			queue = append(queue, libPath)
+		}
+	}
+	return deps, missing
+}
+
+// isExcluded returns true if libName matches an exclude glob
+func (r *elfResolver) isExcluded(libName string) bool {
+	for _, pattern := range r.exclude {
+		if matched, _ := filepath.Match(pattern, libName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the path of the library libName matching ident, searching runPaths,
+// the linker cache, then the search directories.  Returns empty if it is not found.
+func (r *elfResolver) find(libName string, runPaths []string, ident elfIdent) string {
+	candidates := make([]string, 0, len(runPaths)+1+len(r.searchDirs))
+	for _, dir := range runPaths {
+		candidates = append(candidates, filepath.Join(dir, libName))
+	}
+	if libPath, ok := r.linkerCache[libName]; ok {
+		candidates = append(candidates, libPath)
+	}
+	for _, dir := range r.searchDirs {
+		candidates = append(candidates, filepath.Join(dir, libName))
+	}
+	for _, candidate := range candidates {
+		if _, _, candidateIdent, ok := readELFDynamic(candidate); ok && candidateIdent == ident {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// readELFDynamic returns the DT_NEEDED library names of the ELF file at path, its RUNPATH
+// (or RPATH) directories, and its ident.  Returns false if it is not a readable ELF file.
+func readELFDynamic(path string) (needed []string, runPaths []string, ident elfIdent, ok bool) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, nil, elfIdent{}, false
+	}
+	defer f.Close()
+
+	ident = elfIdent{class: f.Class, machine: f.Machine}
+	needed, _ = f.ImportedLibraries()
+	runPathEntries, _ := f.DynString(elf.DT_RUNPATH)
+	if len(runPathEntries) == 0 {
+		runPathEntries, _ = f.DynString(elf.DT_RPATH)
+	}
+	origin := filepath.Dir(path)
+	for _, entry := range runPathEntries {
+		for _, dir := range strings.Split(entry, ":") {
+			dir = strings.ReplaceAll(strings.ReplaceAll(dir, "${ORIGIN}", origin), "$ORIGIN", origin)
+			if dir != "" {
+				runPaths = append(runPaths, dir)
+			}
+		}
+	}
+	return needed, runPaths, ident, true
+}
+
+// symlinkChain returns path followed by each path its symlinks lead to, like
+// `libonload.so` -> `libonload.so.1` -> `libonload.so.1.0.0`
+func symlinkChain(path string) []string {
+	chain := []string{path}
+	for i := 0; i < maxSymlinkHops; i++ {
+		target, err := os.Readlink(path)
+		if err != nil {
+			break // not a symlink
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		if slices.Contains(chain, target) {
+			break
+		}
+		chain = append(chain, target)
+		path = target
+	}
+	return chain
+}
@@ -0,0 +1,223 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestELF writes a minimal 64-bit ELF shared object for machine to path, with
+// DT_NEEDED entries for needed, and a DT_RUNPATH of runPath if set
+func writeTestELF(t *testing.T, path string, machine elf.Machine, needed []string, runPath string) {
+	t.Helper()
+	const headerSize, sectionSize, dynSize = 64, 64, 16
+
+	dynstr := []byte{0}
+	addString := func(s string) uint64 {
+		offset := uint64(len(dynstr))
+		dynstr = append(append(dynstr, s...), 0)
+		return offset
+	}
+	var dynamic []elf.Dyn64
+	for _, libName := range needed {
+		dynamic = append(dynamic, elf.Dyn64{Tag: int64(elf.DT_NEEDED), Val: addString(libName)})
+	}
+	if runPath != "" {
+		dynamic = append(dynamic, elf.Dyn64{Tag: int64(elf.DT_RUNPATH), Val: addString(runPath)})
+	}
+	dynamic = append(dynamic, elf.Dyn64{Tag: int64(elf.DT_NULL)})
+	shstrtab := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+
+	dynstrOff := uint64(headerSize)
+	dynamicOff := dynstrOff + uint64(len(dynstr))
+	shstrtabOff := dynamicOff + uint64(len(dynamic)*dynSize)
+	sectionsOff := shstrtabOff + uint64(len(shstrtab))
+
+	var buf bytes.Buffer
+	header := elf.Header64{
+		Type:      uint16(elf.ET_DYN),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     sectionsOff,
+		Ehsize:    headerSize,
+		Shentsize: sectionSize,
+		Shnum:     4,
+		Shstrndx:  3,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(dynstr)
+	binary.Write(&buf, binary.LittleEndian, dynamic)
+	buf.Write(shstrtab)
+	binary.Write(&buf, binary.LittleEndian, []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: dynstrOff, Size: uint64(len(dynstr)), Addralign: 1},
+		{Name: 9, Type: uint32(elf.SHT_DYNAMIC), Off: dynamicOff, Size: uint64(len(dynamic) * dynSize), Link: 1, Addralign: 8, Entsize: dynSize},
+		{Name: 18, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint64(len(shstrtab)), Addralign: 1},
+	})
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func symlinkTest(t *testing.T, target string, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestELFResolverClosure(t *testing.T) {
+	dir := t.TempDir()
+	libDir := filepath.Join(dir, "lib")
+	otherDir := filepath.Join(dir, "other")
+
+	// root -> libA.so.1 -> libA.so.1.2, needing libB.so.2, libc.so.6 and libmissing.so.1;
+	// libB.so.2 is first found for another machine, and needs libA.so.1 again
+	root := filepath.Join(libDir, "libroot.so")
+	writeTestELF(t, root, elf.EM_X86_64, []string{"libA.so.1"}, "")
+	writeTestELF(t, filepath.Join(libDir, "libA.so.1.2"), elf.EM_X86_64, []string{"libB.so.2", "libc.so.6", "libmissing.so.1"}, "")
+	symlinkTest(t, "libA.so.1.2", filepath.Join(libDir, "libA.so.1"))
+	writeTestELF(t, filepath.Join(otherDir, "libB.so.2"), elf.EM_AARCH64, nil, "")
+	writeTestELF(t, filepath.Join(libDir, "libB.so.2"), elf.EM_X86_64, []string{"libA.so.1"}, "")
+	writeTestELF(t, filepath.Join(libDir, "libc.so.6"), elf.EM_X86_64, nil, "")
+
+	// files which are not ELF are skipped
+	script := filepath.Join(dir, "script")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &elfResolver{
+		searchDirs: []string{otherDir, libDir},
+		exclude:    []string{"libc.so.*"},
+	}
+	deps, missing := r.closure([]string{root, script})
+	wantDeps := []string{
+		filepath.Join(libDir, "libA.so.1"),
+		filepath.Join(libDir, "libA.so.1.2"),
+		filepath.Join(libDir, "libB.so.2"),
+	}
+	if !reflect.DeepEqual(deps, wantDeps) {
+		t.Errorf("deps = %v, want %v", deps, wantDeps)
+	}
+	if wantMissing := []string{"libmissing.so.1"}; !reflect.DeepEqual(missing, wantMissing) {
+		t.Errorf("missing = %v, want %v", missing, wantMissing)
+	}
+
+	// the linker cache is searched before the search directories
+	cachedDir := filepath.Join(dir, "cached")
+	writeTestELF(t, filepath.Join(cachedDir, "libA.so.1"), elf.EM_X86_64, nil, "")
+	r.linkerCache = map[string]string{"libA.so.1": filepath.Join(cachedDir, "libA.so.1")}
+	deps, missing = r.closure([]string{root})
+	if wantDeps := []string{filepath.Join(cachedDir, "libA.so.1")}; !reflect.DeepEqual(deps, wantDeps) {
+		t.Errorf("deps with linker cache = %v, want %v", deps, wantDeps)
+	}
+	if len(missing) != 0 {
+		t.Errorf("missing with linker cache = %v, want none", missing)
+	}
+}
+
+func TestELFResolverSymlinkedRoot(t *testing.T) {
+	dir := t.TempDir()
+
+	// libonload.so -> libonload.so.1 -> libonload.so.1.0.0, needing libdep.so.1
+	root := filepath.Join(dir, "libonload.so")
+	writeTestELF(t, filepath.Join(dir, "libonload.so.1.0.0"), elf.EM_X86_64, []string{"libdep.so.1"}, "")
+	symlinkTest(t, "libonload.so.1.0.0", filepath.Join(dir, "libonload.so.1"))
+	symlinkTest(t, "libonload.so.1", root)
+	writeTestELF(t, filepath.Join(dir, "libdep.so.1"), elf.EM_X86_64, nil, "")
+
+	r := &elfResolver{searchDirs: []string{dir}}
+	deps, missing := r.closure([]string{root})
+	wantDeps := []string{
+		filepath.Join(dir, "libonload.so.1"),
+		filepath.Join(dir, "libonload.so.1.0.0"),
+		filepath.Join(dir, "libdep.so.1"),
+	}
+	if !reflect.DeepEqual(deps, wantDeps) {
+		t.Errorf("deps = %v, want %v", deps, wantDeps)
+	}
+	if len(missing) != 0 {
+		t.Errorf("missing = %v, want none", missing)
+	}
+}
+
+func TestELFResolverOrigin(t *testing.T) {
+	dir := t.TempDir()
+	binDir := filepath.Join(dir, "bin")
+	libDir := filepath.Join(dir, "lib")
+	privDir := filepath.Join(dir, "private")
+
+	tool := filepath.Join(binDir, "tool")
+	writeTestELF(t, tool, elf.EM_X86_64, []string{"libA.so", "libB.so"}, "$ORIGIN/../lib:${ORIGIN}/../private")
+	writeTestELF(t, filepath.Join(libDir, "libA.so"), elf.EM_X86_64, nil, "")
+	writeTestELF(t, filepath.Join(privDir, "libB.so"), elf.EM_X86_64, nil, "")
+
+	_, runPaths, _, ok := readELFDynamic(tool)
+	if !ok {
+		t.Fatalf("readELFDynamic(%s) failed", tool)
+	}
+	wantRunPaths := []string{binDir + "/../lib", binDir + "/../private"}
+	if !reflect.DeepEqual(runPaths, wantRunPaths) {
+		t.Errorf("runPaths = %v, want %v", runPaths, wantRunPaths)
+	}
+
+	r := &elfResolver{}
+	deps, missing := r.closure([]string{tool})
+	wantDeps := []string{filepath.Join(libDir, "libA.so"), filepath.Join(privDir, "libB.so")}
+	if !reflect.DeepEqual(deps, wantDeps) {
+		t.Errorf("deps = %v, want %v", deps, wantDeps)
+	}
+	if len(missing) != 0 {
+		t.Errorf("missing = %v, want none", missing)
+	}
+}
+
+func TestSymlinkChain(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "libonload.so.1.0.0")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	symlinkTest(t, "libonload.so.1.0.0", filepath.Join(dir, "libonload.so.1"))
+	symlinkTest(t, filepath.Join(dir, "libonload.so.1"), filepath.Join(dir, "libonload.so"))
+	symlinkTest(t, "loop-b", filepath.Join(dir, "loop-a"))
+	symlinkTest(t, "loop-a", filepath.Join(dir, "loop-b"))
+
+	tests := []struct {
+		name string
+		path string
+		want []string
+	}{
+		{"file", file, []string{file}},
+		{"missing", filepath.Join(dir, "missing"), []string{filepath.Join(dir, "missing")}},
+		{"relative and absolute links", filepath.Join(dir, "libonload.so"), []string{
+			filepath.Join(dir, "libonload.so"),
+			filepath.Join(dir, "libonload.so.1"),
+			file,
+		}},
+		{"loop", filepath.Join(dir, "loop-a"), []string{filepath.Join(dir, "loop-a"), filepath.Join(dir, "loop-b")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := symlinkChain(tt.path); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("symlinkChain(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
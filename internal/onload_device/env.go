@@ -0,0 +1,137 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Default environment variables, like Onload's `EF_*` tuning, may be configured per
+// device type (`device_type_env`) and per interface (`interface_env`), rather than
+// copied into every job.  Their values are Go templates of the reserved device's envFacts,
+// like `{{.Interface}}`.  An interface's variables override its device type's.  For an
+// Onload profile device type, like `onload-latency`, the layers are, from lowest to highest:
+// those of `onload`, the profile's settings, those of `onload-latency`, then the interface's.
+
+// envFacts are the facts of a reserved device, available to environment templates
+type envFacts struct {
+	DeviceID   string // pseudo-device ID, like "eth0-3"
+	DeviceType string // like "onload"
+	Interface  string // like "eth0", or "none"
+	PCIBusID   string // like "0000:01:00.0", or empty if unknown
+	NUMANode   string // NUMA node of the interface, like "0", or empty if unknown
+}
+
+// newEnvFacts returns the envFacts of device
+func newEnvFacts(device *FingerprintDeviceData) envFacts {
+	facts := envFacts{
+		DeviceID:   device.ID,
+		DeviceType: device.DeviceType,
+		Interface:  device.Interface,
+		PCIBusID:   device.PCIBusID,
+	}
+	if device.PCIBusID != "" {
+		if node, err := ProbeNUMANode(device.PCIBusID); err == nil && node >= 0 {
+			facts.NUMANode = strconv.Itoa(node)
+		}
+	}
+	return facts
+}
+
+// sortedEnvNames returns the names of envs, sorted
+func sortedEnvNames(envs map[string]string) []string {
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderEnv returns envs with their values rendered as templates of facts.
+// Returns the error of the first failing variable, by name.
+func renderEnv(envs map[string]string, facts envFacts) (map[string]string, error) {
+	rendered := make(map[string]string, len(envs))
+	for _, name := range sortedEnvNames(envs) {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(envs[name])
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s template malformed: %w", name, err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, facts); err != nil {
+			return nil, fmt.Errorf("environment variable %s template failed: %w", name, err)
+		}
+		rendered[name] = b.String()
+	}
+	return rendered, nil
+}
+
+// validateEnvTemplates returns an error for each malformed environment variable name
+// or template of setting, which maps keys to environment variables
+func validateEnvTemplates(setting string, envsByKey map[string]map[string]string) []error {
+	keys := make([]string, 0, len(envsByKey))
+	for key := range envsByKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		envs := envsByKey[key]
+		for _, name := range sortedEnvNames(envs) {
+			if name == "" || strings.ContainsAny(name, "= \t\n") {
+				errs = append(errs, fmt.Errorf("%s: %s: invalid environment variable name %q", setting, key, name))
+			}
+		}
+		// render with empty facts, catching unknown facts too
+		if _, err := renderEnv(envs, envFacts{}); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", setting, key, err))
+		}
+	}
+	return errs
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// reserveDefaultEnv sets the configured environment variables of device's type, overridden
+// by those of its interface.  For Onload profile device types, profileEnv, which is not
+// templated, overrides those of "onload", and is overridden by those of the profile's type.
+func (d *OnloadDevicePlugin) reserveDefaultEnv(cfg *OnloadDevicePluginConfig, b *reservationBuilder, device *FingerprintDeviceData, profileEnv map[string]string) {
+	type envLayer struct {
+		envs      map[string]string
+		templated bool
+	}
+	var layers []envLayer
+	if _, isProfile := profileOfDeviceType(device.DeviceType); isProfile {
+		layers = append(layers, envLayer{cfg.DeviceTypeEnv[deviceType_Onload], true}, envLayer{profileEnv, false})
+	}
+	layers = append(layers, envLayer{cfg.DeviceTypeEnv[device.DeviceType], true}, envLayer{cfg.InterfaceEnv[device.Interface], true})
+
+	var facts *envFacts // probed once needed
+	merged := make(map[string]string)
+	for _, layer := range layers {
+		envs := layer.envs
+		if layer.templated && len(envs) != 0 {
+			if facts == nil {
+				deviceFacts := newEnvFacts(device)
+				facts = &deviceFacts
+			}
+			var err error
+			if envs, err = renderEnv(envs, *facts); err != nil {
+				b.addError(fmt.Errorf("device %s: %w", device.ID, err))
+				return
+			}
+		}
+		for name, value := range envs {
+			merged[name] = value
+		}
+	}
+	for _, name := range sortedEnvNames(merged) {
+		b.setEnv(name, merged[name])
+	}
+}
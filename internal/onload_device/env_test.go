@@ -0,0 +1,80 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"reflect"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+func TestReserveDefaultEnvPrecedence(t *testing.T) {
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	cfg := &OnloadDevicePluginConfig{
+		DeviceTypeEnv: map[string]map[string]string{
+			"onload": {
+				"EF_ONLOAD":  "onload",
+				"EF_PROFILE": "onload",
+				"EF_TYPE":    "onload",
+				"EF_IFACE":   "onload",
+			},
+			"onload-latency": {
+				"EF_TYPE":  "{{.DeviceType}}",
+				"EF_IFACE": "onload-latency",
+			},
+		},
+		InterfaceEnv: map[string]map[string]string{
+			"eth0": {"EF_IFACE": "{{.Interface}}"},
+		},
+	}
+	profileEnv := map[string]string{
+		"EF_PROFILE": "profile",
+		"EF_TYPE":    "profile",
+		"EF_IFACE":   "profile",
+		"EF_RAW":     "{{.Interface}}", // not templated
+	}
+
+	tests := []struct {
+		name       string
+		device     *FingerprintDeviceData
+		profileEnv map[string]string
+		want       map[string]string
+	}{
+		{
+			name:       "profile",
+			device:     &FingerprintDeviceData{ID: "eth0-0", DeviceType: "onload-latency", Interface: "eth0"},
+			profileEnv: profileEnv,
+			want: map[string]string{
+				"EF_ONLOAD":  "onload",
+				"EF_PROFILE": "profile",
+				"EF_TYPE":    "onload-latency",
+				"EF_IFACE":   "eth0",
+				"EF_RAW":     "{{.Interface}}",
+			},
+		},
+		{
+			name:   "onload",
+			device: &FingerprintDeviceData{ID: "eth1-0", DeviceType: "onload", Interface: "eth1"},
+			want: map[string]string{
+				"EF_ONLOAD":  "onload",
+				"EF_PROFILE": "onload",
+				"EF_TYPE":    "onload",
+				"EF_IFACE":   "onload",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReservationBuilder()
+			d.reserveDefaultEnv(cfg, b, tt.device, tt.profileEnv)
+			if len(b.errs) != 0 {
+				t.Fatalf("errors: %v", b.errs)
+			}
+			if !reflect.DeepEqual(b.envs, tt.want) {
+				t.Errorf("envs = %v, want %v", b.envs, tt.want)
+			}
+		})
+	}
+}
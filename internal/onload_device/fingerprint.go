@@ -5,7 +5,12 @@ package onload_device
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/nomad/helper/pointer"
@@ -27,11 +32,14 @@ import (
 
 // FingerprintDeviceData is a device record from fingerprinting
 type FingerprintDeviceData struct {
-	Interface  string // also its Name
+	ID         string // pseudo-device ID
+	Interface  string // current interface name
 	DeviceType string
 	Vendor     string
-	Model      string
+	Model      string // interface name, or stable key per `device_id_source`
 	PCIBusID   string
+	Healthy    bool
+	HealthDesc string
 }
 
 func (d *FingerprintDeviceData) GroupNameKey() string {
@@ -40,39 +48,106 @@ func (d *FingerprintDeviceData) GroupNameKey() string {
 
 // FingerprintData represets attributes of driver/devices
 type FingerprintData struct {
-	Devices   []*FingerprintDeviceData
-	OOVersion string // OpenOnload (OO) version
-	ZFVersion string // TCPDirect (ZF) version
+	Devices      []*FingerprintDeviceData
+	OOVersion    string            // OpenOnload (OO) version
+	ZFVersion    string            // TCPDirect (ZF) version
+	ModuleParams map[string]string // "<module>/<parameter>" -> value
+	HostLayout   HostLayout        // Host paths, with `auto` ones resolved
+	Profiles     []string          // Onload profile names, like "latency"
 }
 
-func (d *OnloadDevicePlugin) getFingerprintData() (*FingerprintData, error) {
+func (d *OnloadDevicePlugin) getFingerprintData(ctx context.Context, cfg *OnloadDevicePluginConfig) (*FingerprintData, error) {
 	// "discover" Onload and any NICs
-	// This may change dynamically, if Onload is installed while the Nomad agent is running
-	ooVersion, err := ProbeOnloadVersion(d.config.HostOnloadBinPath)
-	if err != nil {
-		d.logger.Info("Onload not found", "err", err.Error())
+	// This may change dynamically, if Onload is installed while the Nomad agent is running.
+	// The probes run concurrently, each with a timeout, falling back to their last good result.
+	// The `auto` host paths are resolved first, as the version probes depend on them.
+	probes := d.getProbes()
+	if cfg.usesHostLayout() {
+		layout, layoutErr := runProbe(ctx, probes, "host_layout", func(ctx context.Context) (HostLayout, error) {
+			return ProbeHostLayout(ctx), nil
+		})
+		d.logProbeError("Issue probing host layout", layoutErr)
+		cfg = cfg.withHostLayout(layout)
 	}
 
-	zfVersion, err := ProbeZFVersion(d.config.HostZfBinPath)
-	if err != nil {
-		d.logger.Info("TCPDirect not found", "err", err.Error())
-	}
+	var ooVersion, zfVersion string
+	var moduleParams map[string]string
+	var profiles []string
+	var sfcDevs, xdpDevs, ppsDevs, ptpDevs []DeviceInfo
+	var nicResources map[string]NicResources
+	var ooErr, zfErr, paramsErr, profilesErr, sfcErr, xdpErr, ppsErr, ptpErr, resErr error
+	runConcurrently(
+		func() {
+			ooVersion, ooErr = runProbe(ctx, probes, "onload_version", func(ctx context.Context) (string, error) {
+				return ProbeOnloadVersion(ctx, cfg.HostOnloadBinPath)
+			})
+		},
+		func() {
+			zfVersion, zfErr = runProbe(ctx, probes, "zf_version", func(ctx context.Context) (string, error) {
+				return ProbeZFVersion(ctx, cfg.HostZfBinPath)
+			})
+		},
+		func() {
+			moduleParams, paramsErr = runProbe(ctx, probes, "module_parameters", func(ctx context.Context) (map[string]string, error) {
+				return ProbeModuleParameters(cfg.ModuleParameters)
+			})
+		},
+		func() {
+			if cfg.HostProfileDirPath != "" {
+				profiles, profilesErr = runProbe(ctx, probes, "onload_profiles", func(ctx context.Context) ([]string, error) {
+					return ProbeOnloadProfiles(cfg.HostProfileDirPath)
+				})
+			}
+		},
+		func() {
+			if cfg.ProbeSFC {
+				sfcDevs, sfcErr = runProbe(ctx, probes, "sfc_nics", ProbeOnloadSFCNics)
+			}
+		},
+		func() {
+			if cfg.ProbeXDP {
+				xdpDevs, xdpErr = runProbe(ctx, probes, "xdp_nics", func(ctx context.Context) ([]DeviceInfo, error) {
+					return ProbeOnloadXDPNics()
+				})
+			}
+		},
+		func() {
+			// NIC resources are only needed when auto-sizing pseudo-devices
+			if cfg.NumPsuedoNICAuto {
+				nicResources, resErr = runProbe(ctx, probes, "sfc_nic_resources", func(ctx context.Context) (map[string]NicResources, error) {
+					return ProbeSFCNicResources()
+				})
+			}
+		},
+		func() {
+			if cfg.ProbePPS {
+				ppsDevs, ppsErr = runProbe(ctx, probes, "pps", func(ctx context.Context) ([]DeviceInfo, error) {
+					return ProbePPS()
+				})
+			}
+		},
+		func() {
+			if cfg.ProbePTP {
+				ptpDevs, ptpErr = runProbe(ctx, probes, "ptp", func(ctx context.Context) ([]DeviceInfo, error) {
+					return ProbePTP()
+				})
+			}
+		},
+	)
+
+	d.logProbeError("Onload not found", ooErr)
+	d.logProbeError("TCPDirect not found", zfErr)
+	d.logProbeError("Issue probing kernel module parameters", paramsErr)
+	d.logProbeError("Issue probing Onload profiles", profilesErr)
+	d.logProbeError("Issue probing SFC NICs", sfcErr)
+	d.logProbeError("Issue probing XDP NICs", xdpErr)
+	d.logProbeError("Issue probing SFC NIC resources, using the fallback count", resErr)
+	d.logProbeError("Issue probing PPS devices", ppsErr)
+	d.logProbeError("Issue probing PTP devices", ptpErr)
 
 	var deviceInfos []DeviceInfo
-	if d.config.ProbeSFC {
-		devs, err := ProbeOnloadSFCNics()
-		if err != nil {
-			d.logger.Info("Issue probing SFC NICs", "err", err.Error())
-		}
-		deviceInfos = append(deviceInfos, devs...)
-	}
-	if d.config.ProbeXDP {
-		devs, err := ProbeOnloadXDPNics()
-		if err != nil {
-			d.logger.Info("Issue probing XDP NICs", "err", err.Error())
-		}
-		deviceInfos = append(deviceInfos, devs...)
-	}
+	deviceInfos = append(deviceInfos, sfcDevs...)
+	deviceInfos = append(deviceInfos, xdpDevs...)
 	if len(deviceInfos) == 0 {
 		// if we did not discover any SFC or XDP NIC,s that's OK.
 		// Onload can be used without it, so we publish
@@ -85,66 +160,193 @@ func (d *OnloadDevicePlugin) getFingerprintData() (*FingerprintData, error) {
 		})
 	}
 
-	// list of eligble Onload/ZF device types
+	// list of eligble Onload/ZF device types, per the installed software and config.
+	// Software whose version probe fails, rather than finding it not installed, is presumed
+	// installed, so that its devices are published as unhealthy, rather than vanishing.
+	hasOnload := ooVersion != "" || isProbeFailure(ooErr)
+	hasZF := zfVersion != "" || isProbeFailure(zfErr)
 	var deviceTypes []string
-	if ooVersion != "" {
-		deviceTypes = append(deviceTypes, deviceType_Onload)
-		if zfVersion != "" {
-			deviceTypes = append(deviceTypes, deviceType_ZF, deviceType_OnloadZF)
+	for _, deviceType := range eligibleDeviceTypes(hasOnload, hasZF) {
+		if slices.Contains(cfg.DeviceTypes, deviceType) {
+			deviceTypes = append(deviceTypes, deviceType)
 		}
 	}
+	// plus those of the Onload profiles matching `profile_device_types`
+	if hasOnload {
+		deviceTypes = append(deviceTypes, profileDeviceTypes(profiles, cfg.ProfileDeviceTypes)...)
+	}
 
 	// create the fingerprint device list
+	// devices relying on persistently failing probes are published as unhealthy, with the reasons
 	devices := make([]*FingerprintDeviceData, 0, len(deviceTypes)*len(deviceInfos))
 	for _, dev := range deviceInfos {
+		numPsuedoNIC := d.nicDeviceCount(cfg, dev, nicResources)
+		// the "none" fallback does not rely on the NIC probes
+		nicErrs := []error{sfcErr, xdpErr}
+		if dev.Interface == deviceName_None {
+			nicErrs = nil
+		}
 		for _, deviceType := range deviceTypes {
 			// create pseudo-devices for non-exclusive access
-			d.logger.Info("Fingerprinted NIC device", "deviceType", deviceType, "iface", dev.Interface)
-			devices = append(devices, makePsuedoDeviceFingerprints(d.config.NumPsuedoNIC, deviceType, dev)...)
+			d.logger.Info("Fingerprinted NIC device", "deviceType", deviceType, "iface", dev.Interface, "num", numPsuedoNIC)
+			pdevs := makePsuedoDeviceFingerprints(numPsuedoNIC, deviceType, dev, cfg.DeviceIDSource)
+			_, isProfile := profileOfDeviceType(deviceType)
+			switch {
+			case deviceType == deviceType_Onload:
+				markUnhealthy(pdevs, probeHealthDesc(append([]error{ooErr}, nicErrs...)...))
+			case deviceType == deviceType_ZF:
+				markUnhealthy(pdevs, probeHealthDesc(append([]error{zfErr}, nicErrs...)...))
+			case isProfile:
+				markUnhealthy(pdevs, probeHealthDesc(append([]error{ooErr, profilesErr}, nicErrs...)...))
+			default:
+				markUnhealthy(pdevs, probeHealthDesc(append([]error{ooErr, zfErr}, nicErrs...)...))
+			}
+			devices = append(devices, pdevs...)
 		}
 	}
 
 	// Now lets handle Timekeeping
-	if d.config.ProbePPS {
-		if devs, err := ProbePPS(); err == nil {
-			for _, dev := range devs {
-				d.logger.Info("Fingerprinted PPS device", "deviceType", deviceType_PPS, "iface", dev.Interface)
-				devices = append(devices, makePsuedoDeviceFingerprints(d.config.NumPsuedoPPS, deviceType_PPS, dev)...)
-			}
-		} else {
-			d.logger.Info("Issue probing PPS devices", "err", err.Error())
-		}
+	for _, dev := range ppsDevs {
+		d.logger.Info("Fingerprinted PPS device", "deviceType", deviceType_PPS, "iface", dev.Interface)
+		pdevs := makePsuedoDeviceFingerprints(cfg.NumPsuedoPPS, deviceType_PPS, dev, cfg.DeviceIDSource)
+		markUnhealthy(pdevs, probeHealthDesc(ppsErr))
+		devices = append(devices, pdevs...)
 	}
-	if d.config.ProbePTP {
-		if devs, err := ProbePTP(); err == nil {
-			for _, dev := range devs {
-				d.logger.Info("Fingerprinted PTP device", "deviceType", deviceType_PTP, "iface", dev.Interface)
-				devices = append(devices, makePsuedoDeviceFingerprints(d.config.NumPsuedoPTP, deviceType_PTP, dev)...)
-			}
-		} else {
-			d.logger.Info("Issue probing PTP devices", "err", err.Error())
-		}
+	for _, dev := range ptpDevs {
+		d.logger.Info("Fingerprinted PTP device", "deviceType", deviceType_PTP, "iface", dev.Interface)
+		pdevs := makePsuedoDeviceFingerprints(cfg.NumPsuedoPTP, deviceType_PTP, dev, cfg.DeviceIDSource)
+		markUnhealthy(pdevs, probeHealthDesc(ptpErr))
+		devices = append(devices, pdevs...)
 	}
 
 	// Return the Fingerprint data
 	return &FingerprintData{
-		OOVersion: ooVersion,
-		ZFVersion: zfVersion,
-		Devices:   devices,
+		OOVersion:    ooVersion,
+		ZFVersion:    zfVersion,
+		ModuleParams: moduleParams,
+		HostLayout:   cfg.hostLayout(),
+		Profiles:     profiles,
+		Devices:      devices,
 	}, nil
 }
 
-// Creates pseudo-device fingerprints for non-exclusive access to a device. DeviceID = "<interface>-<pdev-num>", like "eth0-0"
-func makePsuedoDeviceFingerprints(numPsuedoDevices int, deviceType string, devInfo DeviceInfo) []*FingerprintDeviceData {
+// logProbeError logs a probe error at a level according to its class:
+// not installed is informational, while failures are warnings until they
+// become persistent errors.
+func (d *OnloadDevicePlugin) logProbeError(msg string, err error) {
+	var perr *probeError
+	switch {
+	case err == nil:
+		return
+	case !errors.As(err, &perr):
+		d.logger.Warn(msg, "err", err.Error())
+	case perr.class == probeFailure_NotInstalled:
+		d.logger.Info(msg, "err", err.Error())
+	case perr.persistent:
+		d.logger.Error(msg, "err", err.Error(), "class", perr.class)
+	default:
+		d.logger.Warn(msg, "err", err.Error(), "class", perr.class)
+	}
+}
+
+// markUnhealthy marks devices as unhealthy with the given reason, if it is not empty
+func markUnhealthy(devices []*FingerprintDeviceData, healthDesc string) {
+	if healthDesc == "" {
+		return
+	}
+	for _, device := range devices {
+		device.Healthy = false
+		device.HealthDesc = healthDesc
+	}
+}
+
+// eligibleDeviceTypes returns the Onload/ZF device types supported by the installed
+// Onload and TCPDirect.
+//
+//	onload: Onload
+//	zf: TCPDirect, with or without Onload
+//	onloadzf: Onload and TCPDirect
+func eligibleDeviceTypes(hasOnload bool, hasZF bool) []string {
+	var deviceTypes []string
+	if hasOnload {
+		deviceTypes = append(deviceTypes, deviceType_Onload)
+	}
+	if hasZF {
+		deviceTypes = append(deviceTypes, deviceType_ZF)
+	}
+	if hasOnload && hasZF {
+		deviceTypes = append(deviceTypes, deviceType_OnloadZF)
+	}
+	return deviceTypes
+}
+
+// numPsuedoNICDevices returns the number of pseudo-devices to create for a NIC.
+// With `num_nic = "auto"` or `num_nic_auto`, this is the number of Onload stacks that fit in the NIC's
+// available VIs and packet buffers, per the `stack_vis` and `stack_pkt_bufs` budgets.
+// Otherwise, or if the NIC's resources are unknown, it is the `num_nic` count.
+func numPsuedoNICDevices(cfg *OnloadDevicePluginConfig, devInfo DeviceInfo, nicResources map[string]NicResources) int {
+	if !cfg.NumPsuedoNICAuto {
+		return cfg.NumPsuedoNIC
+	}
+	res, ok := nicResources[devInfo.Interface]
+	if !ok {
+		return cfg.NumPsuedoNIC
+	}
+
+	num := -1
+	if cfg.StackVIs > 0 && res.VIs >= 0 {
+		num = res.VIs / cfg.StackVIs
+	}
+	if cfg.StackPktBufs > 0 && res.PktBufs >= 0 {
+		if n := res.PktBufs / cfg.StackPktBufs; num < 0 || n < num {
+			num = n
+		}
+	}
+	if num < 0 {
+		return cfg.NumPsuedoNIC
+	}
+	return num
+}
+
+// nicDeviceCount returns the number of pseudo-devices of a NIC, per numPsuedoNICDevices.
+// The NIC's available resources fall as stacks start, so when auto-sized its highest
+// count is kept, lest the highest pseudo-devices, possibly reserved, disappear.
+// Counts are forgotten when the stack budgets change.
+func (d *OnloadDevicePlugin) nicDeviceCount(cfg *OnloadDevicePluginConfig, devInfo DeviceInfo, nicResources map[string]NicResources) int {
+	num := numPsuedoNICDevices(cfg, devInfo, nicResources)
+	if _, known := nicResources[devInfo.Interface]; !cfg.NumPsuedoNICAuto || !known {
+		return num
+	}
+
+	d.deviceLock.Lock()
+	defer d.deviceLock.Unlock()
+	if budget := [2]int{cfg.StackVIs, cfg.StackPktBufs}; budget != d.nicCountsBudget {
+		d.nicCounts = make(map[string]int)
+		d.nicCountsBudget = budget
+	}
+	key := devInfo.StableKey(cfg.DeviceIDSource)
+	if count, ok := d.nicCounts[key]; ok && count > num {
+		return count
+	}
+	d.nicCounts[key] = num
+	return num
+}
+
+// Creates pseudo-device fingerprints for non-exclusive access to a device. DeviceID = "<key>-<pdev-num>", like "eth0-0".
+// The key is the device's stable key per `idSource`, which is also used as its Model.
+func makePsuedoDeviceFingerprints(numPsuedoDevices int, deviceType string, devInfo DeviceInfo, idSource string) []*FingerprintDeviceData {
+	key := devInfo.StableKey(idSource)
 	var fingprintDevices []*FingerprintDeviceData
 	for i := 0; i < numPsuedoDevices; i++ {
-		deviceID := fmt.Sprintf("%s-%d", devInfo.Interface, i)
+		deviceID := fmt.Sprintf("%s-%d", key, i)
 		fingprintDevices = append(fingprintDevices, &FingerprintDeviceData{
-			Interface:  deviceID,
-			Model:      devInfo.Interface, // hard to know actual Model, so use Interface as specifier
+			ID:         deviceID,
+			Interface:  devInfo.Interface,
+			Model:      key, // hard to know actual Model, so use Interface or stable key as specifier
 			DeviceType: deviceType,
 			Vendor:     devInfo.Vendor,
 			PCIBusID:   devInfo.PCIBusID,
+			Healthy:    true,
 		})
 	}
 	return fingprintDevices
@@ -155,6 +357,17 @@ func makePsuedoDeviceFingerprints(numPsuedoDevices int, deviceType string, devIn
 // doFingerprint is the long-running goroutine that detects device changes
 func (d *OnloadDevicePlugin) doFingerprint(ctx context.Context, devices chan *device.FingerprintResponse) {
 	defer close(devices)
+	cfg := d.getConfig()
+
+	// Watch the drain directory, so operator drains take effect immediately
+	if cfg.DrainDir != "" {
+		go watchPath(ctx, d.logger, cfg.DrainDir, func(string) { d.triggerFingerprint() })
+	}
+
+	// Watch the overlay config, so runtime-safe settings take effect immediately
+	if cfg.OverlayConfigPath != "" {
+		go d.watchOverlayConfig(ctx, cfg.OverlayConfigPath)
+	}
 
 	// Create a timer that will fire immediately for the first detection
 	ticker := time.NewTimer(0)
@@ -163,17 +376,46 @@ func (d *OnloadDevicePlugin) doFingerprint(ctx context.Context, devices chan *de
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			ticker.Reset(d.fingerprintPeriod)
+		case <-d.fingerprintTrigger:
+		}
+
+		d.writeFingerprintToChannel(ctx, devices)
+		if err := d.ledger.expire(); err != nil {
+			d.logger.Error("failed to expire reservation ledger", "error", err)
 		}
+		ticker.Reset(d.nextFingerprintDelay())
+	}
+}
 
-		d.writeFingerprintToChannel(devices)
+// triggerFingerprint requests an immediate fingerprint, without blocking
+func (d *OnloadDevicePlugin) triggerFingerprint() {
+	select {
+	case d.fingerprintTrigger <- struct{}{}:
+	default: // one is already pending
 	}
 }
 
+// nextFingerprintDelay returns the delay until the next fingerprint, which is
+// the `fingerprint_period` unless a failing probe is due to be retried sooner
+func (d *OnloadDevicePlugin) nextFingerprintDelay() time.Duration {
+	d.configLock.RLock()
+	delay, probes := d.fingerprintPeriod, d.probes
+	d.configLock.RUnlock()
+	if retry := probes.nextRetry(); !retry.IsZero() {
+		delay = max(min(delay, time.Until(retry)), 0)
+	}
+	return delay
+}
+
 // writeFingerprintToChannel collects fingerprint info, partitions network devices into
 // "device groups" (by Interface name), and sends the data over the provided channel.
-func (d *OnloadDevicePlugin) writeFingerprintToChannel(devices chan<- *device.FingerprintResponse) {
-	fingerprintData, err := d.getFingerprintData()
+func (d *OnloadDevicePlugin) writeFingerprintToChannel(ctx context.Context, devices chan<- *device.FingerprintResponse) {
+	// snapshot the config, so a concurrent overlay reload applies wholly to the next fingerprint
+	d.configLock.RLock()
+	cfg, ignoredInterfaces := d.config, d.ignoredInterfaces
+	d.configLock.RUnlock()
+
+	fingerprintData, err := d.getFingerprintData(ctx, cfg)
 	if err != nil {
 		d.logger.Error("failed to fingerprint onload devices", "error", err)
 		devices <- device.NewFingerprintError(err)
@@ -182,26 +424,59 @@ func (d *OnloadDevicePlugin) writeFingerprintToChannel(devices chan<- *device.Fi
 	d.logger.Debug("fingerprint results", "len_devices", len(fingerprintData.Devices), "oo", fingerprintData.OOVersion, "zf", fingerprintData.ZFVersion)
 
 	// exclude ignored interfaces
-	fingerprintDevices := ignoreFingerprintedDevices(fingerprintData.Devices, d.ignoredInterfaces)
+	fingerprintDevices := ignoreFingerprintedDevices(fingerprintData.Devices, ignoredInterfaces)
 
-	// check if any device health was updated or any device was added to host
-	if !d.fingerprintChanged(fingerprintDevices) {
-		return
+	// drain Onload devices if Onload was upgraded underneath reserved Tasks
+	d.applyUpgradeDrain(fingerprintDevices, fingerprintData.OOVersion)
+
+	// drain the devices of interfaces drained by the operator
+	d.applyOperatorDrain(fingerprintDevices, cfg.DrainDir)
+
+	// keep reserved devices that disappeared, as unhealthy
+	fingerprintDevices = d.retainRemovedDevices(fingerprintDevices)
+
+	// Build common attributes, starting with the configured ones, which may not replace the built-in ones
+	commonAttributes := make(map[string]*structs.Attribute, len(cfg.Attributes)+2)
+	for name, value := range cfg.Attributes {
+		if !isBuiltinAttribute(name) {
+			commonAttributes[name] = structs.ParseAttribute(value)
+		}
+	}
+	commonAttributes[attr_OnloadVersion] = &structs.Attribute{
+		String: pointer.Of(fingerprintData.OOVersion),
+	}
+	commonAttributes[attr_ZFVersion] = &structs.Attribute{
+		String: pointer.Of(fingerprintData.ZFVersion),
 	}
 
-	// Build common attributes
-	commonAttributes := map[string]*structs.Attribute{
-		attr_OnloadVersion: {
-			String: pointer.Of(fingerprintData.OOVersion),
-		},
-		attr_ZFVersion: {
-			String: pointer.Of(fingerprintData.ZFVersion),
-		},
+	// Build Onload attributes, only applied to Onload/ZF device groups
+	onloadAttributes := make(map[string]*structs.Attribute, len(fingerprintData.ModuleParams))
+	for param, value := range fingerprintData.ModuleParams {
+		onloadAttributes[moduleParamAttributeName(param)] = structs.ParseAttribute(value)
+	}
+	for name, hostPath := range map[string]string{
+		attr_OnloadLibPath:  fingerprintData.HostLayout.OnloadLibPath,
+		attr_OnloadBinPath:  fingerprintData.HostLayout.OnloadBinPath,
+		attr_ProfileDirPath: fingerprintData.HostLayout.ProfileDirPath,
+		attr_ZfLibPath:      fingerprintData.HostLayout.ZfLibPath,
+		attr_ZfBinPath:      fingerprintData.HostLayout.ZfBinPath,
+	} {
+		if hostPath != "" {
+			onloadAttributes[name] = &structs.Attribute{String: pointer.Of(hostPath)}
+		}
 	}
+	if len(fingerprintData.Profiles) != 0 {
+		onloadAttributes[attr_OnloadProfiles] = &structs.Attribute{String: pointer.Of(strings.Join(fingerprintData.Profiles, ","))}
+	}
+
+	// remember the resolved Host paths for Reserve
+	d.deviceLock.Lock()
+	d.hostLayout = fingerprintData.HostLayout
+	d.deviceLock.Unlock()
 
 	// Group all FingerprintDevices by Interface attribute
 	deviceListByGroupNameKey := make(map[string][]*FingerprintDeviceData)
-	for _, device := range fingerprintData.Devices {
+	for _, device := range fingerprintDevices {
 		key := device.GroupNameKey()
 		if key == "" {
 			key = groupName_NotAvailable
@@ -209,10 +484,15 @@ func (d *OnloadDevicePlugin) writeFingerprintToChannel(devices chan<- *device.Fi
 		deviceListByGroupNameKey[key] = append(deviceListByGroupNameKey[key], device)
 	}
 
-	// Build Fingerprint response with computed groups and send it over the channel
+	// Build Fingerprint response with computed groups
 	deviceGroups := make([]*device.DeviceGroup, 0, len(deviceListByGroupNameKey))
 	for groupName, devices := range deviceListByGroupNameKey {
-		deviceGroups = append(deviceGroups, d.deviceGroupFromFingerprintData(groupName, devices, commonAttributes))
+		deviceGroups = append(deviceGroups, d.deviceGroupFromFingerprintData(groupName, devices, commonAttributes, onloadAttributes))
+	}
+
+	// check if anything about the device groups changed, and if so send it over the channel
+	if !d.fingerprintChanged(fingerprintDevices, deviceGroups, fingerprintData.OOVersion, fingerprintData.ZFVersion) {
+		return
 	}
 	devices <- device.NewFingerprint(deviceGroups...)
 }
@@ -228,38 +508,188 @@ func ignoreFingerprintedDevices(deviceData []*FingerprintDeviceData, ignoredInte
 	return result
 }
 
-// fingerprintChanged checks if there are any previously unseen Onload devices located
-// or any of fingerprinted Onload devices disappeared since the last fingerprint run.
-// Also, this func updates the device map on OnloadDevicePlugin with the latest data
-func (d *OnloadDevicePlugin) fingerprintChanged(allDevices []*FingerprintDeviceData) bool {
+// healthDesc_Removed is the health description of reserved devices that disappeared
+const healthDesc_Removed = "device removed"
+
+// retainRemovedDevices returns allDevices along with previously published devices that
+// disappeared while reserved.  They are retained as unhealthy until `removed_device_timeout`,
+// so Nomad keeps track of devices that running allocations still hold.
+func (d *OnloadDevicePlugin) retainRemovedDevices(allDevices []*FingerprintDeviceData) []*FingerprintDeviceData {
+	d.configLock.RLock()
+	removedTimeout := d.removedTimeout
+	d.configLock.RUnlock()
+
 	d.deviceLock.Lock()
 	defer d.deviceLock.Unlock()
 
-	changeDetected := false
-	// check if every device in allDevices is in d.devices
+	present := make(map[string]bool, len(allDevices))
 	for _, device := range allDevices {
-		if _, ok := d.devices[device.Interface]; !ok {
-			changeDetected = true
+		present[device.ID] = true
+		delete(d.removedDevices, device.ID)
+	}
+
+	now := time.Now()
+	for id, prev := range d.devices {
+		if present[id] {
+			continue
+		}
+		if _, reserved := d.reservedDevices[id]; !reserved {
+			continue
+		}
+		removedAt, ok := d.removedDevices[id]
+		if !ok {
+			removedAt = now
+			d.removedDevices[id] = now
+			d.logger.Warn("reserved device removed", "deviceID", id, "iface", prev.Interface)
+		}
+		if now.Sub(removedAt) >= removedTimeout {
+			d.logger.Info("forgetting removed device", "deviceID", id, "iface", prev.Interface)
+			delete(d.removedDevices, id)
+			delete(d.reservedDevices, id)
+			continue
+		}
+		retained := *prev
+		retained.Healthy = false
+		retained.HealthDesc = healthDesc_Removed
+		allDevices = append(allDevices, &retained)
+	}
+	return allDevices
+}
+
+// applyUpgradeDrain marks Onload devices unhealthy while draining after an Onload upgrade.
+// A drain starts when the Onload version differs from the last published one, if
+// `upgrade_drain_period` is set and Tasks have reserved the previous version within
+// `ledger_ttl`.  Onload no longer being detected, with an empty version, is not an upgrade.
+func (d *OnloadDevicePlugin) applyUpgradeDrain(allDevices []*FingerprintDeviceData, ooVersion string) {
+	d.configLock.RLock()
+	upgradeDrainPeriod := d.upgradeDrainPeriod
+	d.configLock.RUnlock()
+
+	d.deviceLock.Lock()
+	defer d.deviceLock.Unlock()
+
+	// reserved versions age out like the ledger's entries
+	now := time.Now()
+	for version, reservedAt := range d.reservedVersions {
+		if now.Sub(reservedAt) >= d.ledger.ttl {
+			delete(d.reservedVersions, version)
+		}
+	}
+
+	if d.ooVersion != "" && ooVersion != "" && d.ooVersion != ooVersion {
+		d.logger.Info("Onload version changed", "from", d.ooVersion, "to", ooVersion)
+		if _, reserved := d.reservedVersions[d.ooVersion]; reserved && upgradeDrainPeriod > 0 {
+			d.upgradeDrainUntil = now.Add(upgradeDrainPeriod)
+			d.upgradeDrainDesc = fmt.Sprintf("Onload upgraded from %s to %s, draining until %s",
+				d.ooVersion, ooVersion, d.upgradeDrainUntil.Format(time.RFC3339))
+			d.logger.Warn("draining Onload devices", "until", d.upgradeDrainUntil)
 		}
+		// reservations of the previous version are now accounted for by the drain
+		delete(d.reservedVersions, d.ooVersion)
 	}
 
-	// check if every device in d.devices is in allDevices
+	if now.After(d.upgradeDrainUntil) {
+		return
+	}
+	for _, device := range allDevices {
+		if isOnloadDeviceType(device.DeviceType) {
+			device.Healthy = false
+			device.HealthDesc = d.upgradeDrainDesc
+		}
+	}
+}
+
+// fingerprintChanged checks if the device groups differ in any way from those of the last
+// fingerprint run, including devices, attributes, health and locality.  This compares a hash
+// of their canonical form and logs a concise diff of what changed.
+// Also, this func updates the device map on OnloadDevicePlugin with the latest data
+func (d *OnloadDevicePlugin) fingerprintChanged(allDevices []*FingerprintDeviceData, deviceGroups []*device.DeviceGroup, ooVersion string, zfVersion string) bool {
+	d.deviceLock.Lock()
+	defer d.deviceLock.Unlock()
+
 	fingerprintDeviceMap := make(map[string]*FingerprintDeviceData)
 	for _, device := range allDevices {
-		fingerprintDeviceMap[device.Interface] = device
+		fingerprintDeviceMap[device.ID] = device
+	}
+	d.devices = fingerprintDeviceMap
+	d.zfVersion = zfVersion
+	// keep the last detected Onload version, which a reinstalled one is compared with
+	if ooVersion != "" {
+		d.ooVersion = ooVersion
+	}
+
+	lines := canonicalDeviceGroups(deviceGroups)
+	hash := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	if d.fingerprintLines != nil && hash == d.fingerprintHash {
+		return false
 	}
-	for id := range d.devices {
-		if _, ok := fingerprintDeviceMap[id]; !ok {
-			changeDetected = true
+
+	added, removed := diffLines(d.fingerprintLines, lines)
+	d.logger.Info("fingerprint changed", "added", summarizeLines(added), "removed", summarizeLines(removed))
+	d.fingerprintLines, d.fingerprintHash = lines, hash
+	return true
+}
+
+// canonicalDeviceGroups returns the sorted lines of a canonical form of deviceGroups,
+// one for each group attribute and each device
+func canonicalDeviceGroups(deviceGroups []*device.DeviceGroup) []string {
+	lines := []string{}
+	for _, group := range deviceGroups {
+		if group == nil {
+			continue
+		}
+		groupName := fmt.Sprintf("%s/%s/%s", group.Vendor, group.Type, group.Name)
+		for key, attr := range group.Attributes {
+			lines = append(lines, fmt.Sprintf("%s attr %s=%q", groupName, key, attr.GoString()))
+		}
+		for _, dev := range group.Devices {
+			pciBusID := ""
+			if dev.HwLocality != nil {
+				pciBusID = dev.HwLocality.PciBusID
+			}
+			lines = append(lines, fmt.Sprintf("%s device %s healthy=%t desc=%q pci=%q",
+				groupName, dev.ID, dev.Healthy, dev.HealthDesc, pciBusID))
 		}
 	}
+	sort.Strings(lines)
+	return lines
+}
 
-	d.devices = fingerprintDeviceMap
-	return changeDetected
+// diffLines returns the lines only in `to` (added) and only in `from` (removed)
+func diffLines(from []string, to []string) (added []string, removed []string) {
+	fromSet := make(map[string]bool, len(from))
+	for _, line := range from {
+		fromSet[line] = true
+	}
+	toSet := make(map[string]bool, len(to))
+	for _, line := range to {
+		toSet[line] = true
+		if !fromSet[line] {
+			added = append(added, line)
+		}
+	}
+	for _, line := range from {
+		if !toSet[line] {
+			removed = append(removed, line)
+		}
+	}
+	return added, removed
+}
+
+// maxSummaryLines is the maximum number of diff lines logged by summarizeLines
+const maxSummaryLines = 8
+
+// summarizeLines shortens lines for logging
+func summarizeLines(lines []string) []string {
+	if len(lines) <= maxSummaryLines {
+		return lines
+	}
+	summary := append([]string{}, lines[:maxSummaryLines]...)
+	return append(summary, fmt.Sprintf("... and %d more", len(lines)-maxSummaryLines))
 }
 
 // deviceGroupFromFingerprintData composes deviceGroup from FingerprintDeviceData slice
-func (d *OnloadDevicePlugin) deviceGroupFromFingerprintData(groupName string, deviceList []*FingerprintDeviceData, commonAttributes map[string]*structs.Attribute) *device.DeviceGroup {
+func (d *OnloadDevicePlugin) deviceGroupFromFingerprintData(groupName string, deviceList []*FingerprintDeviceData, commonAttributes map[string]*structs.Attribute, onloadAttributes map[string]*structs.Attribute) *device.DeviceGroup {
 	// deviceGroup without devices makes no sense -> return nil when no devices are provided
 	if len(deviceList) == 0 {
 		return nil
@@ -268,10 +698,9 @@ func (d *OnloadDevicePlugin) deviceGroupFromFingerprintData(groupName string, de
 	devices := make([]*device.Device, 0, len(deviceList))
 	for _, dev := range deviceList {
 		devices = append(devices, &device.Device{
-			ID: dev.Interface,
-			// all fingerprinted devices are "healthy" for now
-			Healthy:    true,
-			HealthDesc: "",
+			ID:         dev.ID,
+			Healthy:    dev.Healthy,
+			HealthDesc: dev.HealthDesc,
 			HwLocality: &device.DeviceLocality{
 				PciBusID: dev.PCIBusID, // This helps the NUMA-aware scheduler =)
 			},
@@ -291,6 +720,37 @@ func (d *OnloadDevicePlugin) deviceGroupFromFingerprintData(groupName string, de
 	for attributeKey, attributeValue := range commonAttributes {
 		deviceGroup.Attributes[attributeKey] = attributeValue
 	}
+	if isOnloadDeviceType(dev.DeviceType) {
+		for attributeKey, attributeValue := range onloadAttributes {
+			deviceGroup.Attributes[attributeKey] = attributeValue
+		}
+	}
+
+	// The current interface name, which differs from the Model with stable keys
+	deviceGroup.Attributes[attr_Interface] = &structs.Attribute{String: pointer.Of(dev.Interface)}
 
 	return deviceGroup
 }
+
+// isOnloadDeviceType returns true if the deviceType is one of the Onload/ZF device types,
+// including the Onload profile ones
+func isOnloadDeviceType(deviceType string) bool {
+	switch deviceType {
+	case deviceType_Onload, deviceType_ZF, deviceType_OnloadZF:
+		return true
+	default:
+		_, isProfile := profileOfDeviceType(deviceType)
+		return isProfile
+	}
+}
+
+// isBuiltinAttribute returns true if name is published by the plugin, so it may not be configured
+func isBuiltinAttribute(name string) bool {
+	return slices.Contains(builtinAttributes, name) || strings.HasPrefix(name, attr_ModuleParamPrefix)
+}
+
+// moduleParamAttributeName converts a "<module>/<parameter>" into an attribute name,
+// like "modparam_onload_max_layer2_interfaces"
+func moduleParamAttributeName(param string) string {
+	return attr_ModuleParamPrefix + strings.ReplaceAll(param, "/", "_")
+}
@@ -0,0 +1,212 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/device"
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+func TestApplyUpgradeDrain(t *testing.T) {
+	newPlugin := func(reservedAt time.Time) *OnloadDevicePlugin {
+		d := NewOnloadDevicePlugin(log.NewNullLogger())
+		d.ledger = newReservationLedger("", time.Hour)
+		d.upgradeDrainPeriod = time.Minute
+		d.ooVersion = "8.1.0"
+		d.reservedVersions["8.1.0"] = reservedAt
+		return d
+	}
+	drained := func(d *OnloadDevicePlugin, ooVersion string) bool {
+		devices := []*FingerprintDeviceData{{ID: "eth0-0", DeviceType: deviceType_Onload, Healthy: true}}
+		d.applyUpgradeDrain(devices, ooVersion)
+		return !devices[0].Healthy
+	}
+
+	// Onload no longer detected is not an upgrade, and its version is kept to compare with
+	d := newPlugin(time.Now())
+	if drained(d, "") {
+		t.Error("drained when Onload is no longer detected")
+	}
+	d.fingerprintChanged(nil, nil, "", "")
+	if d.ooVersion != "8.1.0" {
+		t.Errorf("ooVersion = %q after Onload is no longer detected, want 8.1.0", d.ooVersion)
+	}
+	if !drained(d, "8.2.0") {
+		t.Error("not drained when Onload is reinstalled with another version")
+	}
+
+	// the same version is not an upgrade
+	if d := newPlugin(time.Now()); drained(d, "8.1.0") {
+		t.Error("drained without an upgrade")
+	}
+
+	// reservations older than the ledger TTL are forgotten
+	d = newPlugin(time.Now().Add(-2 * time.Hour))
+	if drained(d, "8.2.0") {
+		t.Error("drained for a reservation older than the ledger TTL")
+	}
+	if len(d.reservedVersions) != 0 {
+		t.Errorf("reservedVersions = %v, want them expired", d.reservedVersions)
+	}
+}
+
+func TestFingerprintOnloadProbeFailure(t *testing.T) {
+	// `onload --version` crashes, and TCPDirect is not installed
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "onload"), []byte("#!/bin/sh\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	d.probes = newProbeRunner(5*time.Second, time.Hour, time.Minute, time.Minute)
+	cfg := &OnloadDevicePluginConfig{
+		HostOnloadBinPath: binDir,
+		HostZfBinPath:     filepath.Join(binDir, "missing"),
+		DeviceTypes:       []string{deviceType_Onload, deviceType_ZF, deviceType_OnloadZF},
+		NumPsuedoNIC:      1,
+	}
+	data, err := d.getFingerprintData(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Devices) != 1 {
+		t.Fatalf("devices = %v, want one onload device", data.Devices)
+	}
+	dev := data.Devices[0]
+	if dev.DeviceType != deviceType_Onload || dev.Healthy || !strings.Contains(dev.HealthDesc, probeFailure_Failed) {
+		t.Errorf("device = %+v, want an unhealthy onload device", dev)
+	}
+}
+
+func TestRetainRemovedDevices(t *testing.T) {
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	d.removedTimeout = time.Minute
+	d.devices = map[string]*FingerprintDeviceData{
+		"eth0-0": {ID: "eth0-0", DeviceType: deviceType_Onload, Interface: "eth0", Healthy: true},
+		"eth1-0": {ID: "eth1-0", DeviceType: deviceType_Onload, Interface: "eth1", Healthy: true},
+		"eth2-0": {ID: "eth2-0", DeviceType: deviceType_Onload, Interface: "eth2", Healthy: true},
+	}
+	d.reservedDevices["eth1-0"] = time.Now()
+	d.reservedDevices["eth2-0"] = time.Now()
+
+	// eth1-0 and eth2-0 disappear: only the reserved ones are retained, as unhealthy
+	present := []*FingerprintDeviceData{{ID: "eth2-0", DeviceType: deviceType_Onload, Interface: "eth2", Healthy: true}}
+	devices := d.retainRemovedDevices(present)
+	if len(devices) != 2 || devices[1].ID != "eth1-0" || devices[1].Healthy || devices[1].HealthDesc != healthDesc_Removed {
+		t.Fatalf("devices = %+v, want eth2-0 and an unhealthy eth1-0", devices)
+	}
+	if !d.devices["eth1-0"].Healthy {
+		t.Error("retaining eth1-0 modified the published device")
+	}
+
+	// still retained within removed_device_timeout
+	if devices := d.retainRemovedDevices(present); len(devices) != 2 {
+		t.Errorf("devices = %+v, want eth1-0 still retained", devices)
+	}
+
+	// forgotten after removed_device_timeout
+	d.removedDevices["eth1-0"] = time.Now().Add(-time.Hour)
+	if devices := d.retainRemovedDevices(present); len(devices) != 1 {
+		t.Errorf("devices = %+v, want eth1-0 forgotten", devices)
+	}
+	if _, ok := d.reservedDevices["eth1-0"]; ok {
+		t.Error("eth1-0 still reserved after being forgotten")
+	}
+
+	// a device which reappears is no longer removed
+	d.reservedDevices["eth1-0"] = time.Now()
+	d.retainRemovedDevices(present)
+	d.retainRemovedDevices(append(present, &FingerprintDeviceData{ID: "eth1-0", DeviceType: deviceType_Onload, Interface: "eth1", Healthy: true}))
+	if _, ok := d.removedDevices["eth1-0"]; ok {
+		t.Error("eth1-0 still removed after reappearing")
+	}
+}
+
+func TestFingerprintChanged(t *testing.T) {
+	var logs bytes.Buffer
+	d := NewOnloadDevicePlugin(log.New(&log.LoggerOptions{Output: &logs, Level: log.Info}))
+	newGroup := func(name string, version string, ids ...string) *device.DeviceGroup {
+		group := &device.DeviceGroup{
+			Vendor: "solarflare",
+			Type:   deviceType_Onload,
+			Name:   name,
+			Attributes: map[string]*structs.Attribute{
+				"onload_version": structs.NewStringAttribute(version),
+				"interface":      structs.NewStringAttribute(name),
+			},
+		}
+		for _, id := range ids {
+			group.Devices = append(group.Devices, &device.Device{ID: id, Healthy: true})
+		}
+		return group
+	}
+
+	// the first fingerprint is a change
+	if !d.fingerprintChanged(nil, []*device.DeviceGroup{newGroup("eth0", "8.1.0", "eth0-0", "eth0-1"), newGroup("eth1", "8.1.0", "eth1-0")}, "8.1.0", "") {
+		t.Error("first fingerprint is unchanged")
+	}
+	hash := d.fingerprintHash
+
+	// reordering groups and devices leaves the canonical hash unchanged
+	if d.fingerprintChanged(nil, []*device.DeviceGroup{newGroup("eth1", "8.1.0", "eth1-0"), nil, newGroup("eth0", "8.1.0", "eth0-1", "eth0-0")}, "8.1.0", "") {
+		t.Error("reordered fingerprint changed")
+	}
+	if d.fingerprintHash != hash {
+		t.Error("reordered fingerprint changed the hash")
+	}
+
+	// an attribute change is detected, logging what was added and removed
+	logs.Reset()
+	if !d.fingerprintChanged(nil, []*device.DeviceGroup{newGroup("eth0", "8.2.0", "eth0-0", "eth0-1"), newGroup("eth1", "8.1.0", "eth1-0")}, "8.2.0", "") {
+		t.Error("attribute change not detected")
+	}
+	if !strings.Contains(logs.String(), "8.2.0") || !strings.Contains(logs.String(), "8.1.0") {
+		t.Errorf("log = %q, want the old and new onload_version", logs.String())
+	}
+
+	// as is a health change
+	unhealthy := newGroup("eth1", "8.1.0", "eth1-0")
+	unhealthy.Devices[0].Healthy = false
+	if !d.fingerprintChanged(nil, []*device.DeviceGroup{newGroup("eth0", "8.2.0", "eth0-0", "eth0-1"), unhealthy}, "8.2.0", "") {
+		t.Error("health change not detected")
+	}
+
+	// the logged diff is capped, counting the rest
+	logs.Reset()
+	var ids []string
+	for i := 0; i < 20; i++ {
+		ids = append(ids, fmt.Sprintf("eth2-%d", i))
+	}
+	if !d.fingerprintChanged(nil, []*device.DeviceGroup{newGroup("eth2", "8.2.0", ids...)}, "8.2.0", "") {
+		t.Error("device change not detected")
+	}
+	// 22 lines are added, the group's 2 attributes and its 20 devices
+	if want := fmt.Sprintf("... and %d more", 22-maxSummaryLines); !strings.Contains(logs.String(), want) {
+		t.Errorf("log = %q, want it to contain %q", logs.String(), want)
+	}
+}
+
+func TestSummarizeLines(t *testing.T) {
+	var lines []string
+	for i := 0; i < maxSummaryLines; i++ {
+		lines = append(lines, fmt.Sprint(i))
+	}
+	if got := summarizeLines(lines); len(got) != maxSummaryLines {
+		t.Errorf("summarizeLines of %d lines = %v, want them all", maxSummaryLines, got)
+	}
+	lines = append(lines, "8", "9")
+	got := summarizeLines(lines)
+	if len(got) != maxSummaryLines+1 || got[maxSummaryLines] != "... and 2 more" {
+		t.Errorf("summarizeLines of %d lines = %v, want %d and a count of the rest", len(lines), got, maxSummaryLines)
+	}
+}
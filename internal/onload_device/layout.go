@@ -0,0 +1,179 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Onload's install layout differs across distributions, like `/usr/lib64` on RHEL and
+// `/usr/lib/x86_64-linux-gnu` on Debian.  Host path settings set to `auto` are resolved
+// by searching known locations, then the dynamic linker cache, upon every fingerprint.
+
+// hostPath_Auto is the host path setting value to discover the path
+const hostPath_Auto = "auto"
+
+// layoutLibDirs are searched in order for Onload and TCPDirect libraries
+var layoutLibDirs = []string{
+	"/usr/lib64",
+	"/usr/lib/x86_64-linux-gnu",
+	"/usr/lib/aarch64-linux-gnu",
+	"/opt/onload/lib64",
+	"/opt/onload/lib",
+	"/opt/onload/usr/lib64",
+}
+
+// layoutBinDirs are searched in order for Onload and TCPDirect executables
+var layoutBinDirs = []string{
+	"/usr/bin",
+	"/usr/local/bin",
+	"/opt/onload/bin",
+	"/opt/onload/usr/bin",
+}
+
+// layoutProfileDirs are searched in order for the Onload profiles directory
+var layoutProfileDirs = []string{
+	"/usr/libexec/onload/profiles",
+	"/usr/lib/onload/profiles",
+	"/opt/onload/libexec/onload/profiles",
+	"/opt/onload/usr/libexec/onload/profiles",
+}
+
+// ldconfigPaths are tried in order to run `ldconfig`, which is often not in PATH
+var ldconfigPaths = []string{"/sbin/ldconfig", "/usr/sbin/ldconfig", "ldconfig"}
+
+// HostLayout is where Onload and TCPDirect are installed on the Host.
+// Paths that were not found are empty.
+type HostLayout struct {
+	OnloadLibPath  string // directory of libonload.so
+	OnloadBinPath  string // directory of onload
+	ProfileDirPath string // Onload profiles directory
+	ZfLibPath      string // directory of libonload_zf.so
+	ZfBinPath      string // directory of zf_stackdump
+}
+
+// ProbeHostLayout discovers where Onload and TCPDirect are installed on the Host.
+// Libraries not found in the known directories are looked up in the dynamic linker
+// cache, using `ldconfig -p`, which is killed if `ctx` is done before it completes.
+func ProbeHostLayout(ctx context.Context) HostLayout {
+	var linkerCache map[string]string
+	findLib := func(libName string) string {
+		if dir := findInDirs(layoutLibDirs, libName); dir != "" {
+			return dir
+		}
+		if linkerCache == nil {
+			linkerCache = probeLinkerCache(ctx)
+		}
+		if libPath, ok := linkerCache[libName]; ok {
+			return filepath.Dir(libPath)
+		}
+		return ""
+	}
+
+	layout := HostLayout{
+		OnloadLibPath: findLib(onloadPreloadFile),
+		OnloadBinPath: findInDirs(layoutBinDirs, "onload"),
+		ZfLibPath:     findLib("libonload_zf.so"),
+		ZfBinPath:     findInDirs(layoutBinDirs, "zf_stackdump"),
+	}
+	for _, dir := range layoutProfileDirs {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			layout.ProfileDirPath = dir
+			break
+		}
+	}
+	return layout
+}
+
+// findInDirs returns the first of dirs containing fileName, or empty if none do
+func findInDirs(dirs []string, fileName string) string {
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, fileName)); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+// probeLinkerCache returns the dynamic linker cache, mapping library names to their paths.
+// Failures result in an empty cache, as it is only a fallback.
+func probeLinkerCache(ctx context.Context) map[string]string {
+	cache := make(map[string]string)
+	for _, ldconfigPath := range ldconfigPaths {
+		output, err := exec.CommandContext(ctx, ldconfigPath, "-p").Output()
+		if err != nil {
+			continue
+		}
+		return parseLinkerCache(output)
+	}
+	return cache
+}
+
+// parseLinkerCache parses the output of `ldconfig -p`, mapping library names to their paths.
+// A library listed more than once, such as for several ABIs, maps to its first path.
+func parseLinkerCache(output []byte) map[string]string {
+	cache := make(map[string]string)
+	// lines are like: "	libonload.so (libc6,x86-64) => /usr/lib64/libonload.so"
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok {
+			continue
+		}
+		_, libPath, ok := strings.Cut(rest, "=> ")
+		if !ok {
+			continue
+		}
+		if _, seen := cache[name]; !seen { // the first is preferred
+			cache[name] = strings.TrimSpace(libPath)
+		}
+	}
+	return cache
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// usesHostLayout returns true if any host path setting is `auto`
+func (c *OnloadDevicePluginConfig) usesHostLayout() bool {
+	return c.HostOnloadLibPath == hostPath_Auto || c.HostOnloadBinPath == hostPath_Auto ||
+		c.HostProfileDirPath == hostPath_Auto || c.HostZfLibPath == hostPath_Auto ||
+		c.HostZfBinPath == hostPath_Auto
+}
+
+// withHostLayout returns a copy of the config with its `auto` host paths resolved per layout.
+// Unresolved paths become empty, disabling them.
+func (c *OnloadDevicePluginConfig) withHostLayout(layout HostLayout) *OnloadDevicePluginConfig {
+	if !c.usesHostLayout() {
+		return c
+	}
+	config := *c
+	resolve := func(hostPath *string, resolved string) {
+		if *hostPath == hostPath_Auto {
+			*hostPath = resolved
+		}
+	}
+	resolve(&config.HostOnloadLibPath, layout.OnloadLibPath)
+	resolve(&config.HostOnloadBinPath, layout.OnloadBinPath)
+	resolve(&config.HostProfileDirPath, layout.ProfileDirPath)
+	resolve(&config.HostZfLibPath, layout.ZfLibPath)
+	resolve(&config.HostZfBinPath, layout.ZfBinPath)
+	return &config
+}
+
+// hostLayout returns the config's host paths as a HostLayout
+func (c *OnloadDevicePluginConfig) hostLayout() HostLayout {
+	return HostLayout{
+		OnloadLibPath:  c.HostOnloadLibPath,
+		OnloadBinPath:  c.HostOnloadBinPath,
+		ProfileDirPath: c.HostProfileDirPath,
+		ZfLibPath:      c.HostZfLibPath,
+		ZfBinPath:      c.HostZfBinPath,
+	}
+}
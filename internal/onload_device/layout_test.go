@@ -0,0 +1,133 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLinkerCache(t *testing.T) {
+	output, err := os.ReadFile("testdata/ldconfig/ldconfig-p.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := parseLinkerCache(output)
+	want := map[string]string{
+		"libonload_zf.so.1":    "/opt/onload/lib64/libonload_zf.so.1",
+		"libonload_zf.so":      "/opt/onload/lib64/libonload_zf.so",
+		"libonload.so":         "/opt/onload/lib64/libonload.so", // the first ABI listed
+		"libm.so.6":            "/lib/x86_64-linux-gnu/libm.so.6",
+		"libc.so.6":            "/lib/x86_64-linux-gnu/libc.so.6",
+		"ld-linux-x86-64.so.2": "/lib64/ld-linux-x86-64.so.2",
+	}
+	if !reflect.DeepEqual(cache, want) {
+		t.Errorf("parseLinkerCache = %v, want %v", cache, want)
+	}
+
+	if cache := parseLinkerCache(nil); len(cache) != 0 {
+		t.Errorf("parseLinkerCache of no output = %v, want empty", cache)
+	}
+}
+
+// setTestLayout points the layout search at dirs under root and `ldconfig` at a script
+// printing the fixture, restoring them when the test ends
+func setTestLayout(t *testing.T, root string) {
+	t.Helper()
+	libDirs, binDirs, profileDirs, ldconfigs := layoutLibDirs, layoutBinDirs, layoutProfileDirs, ldconfigPaths
+	t.Cleanup(func() {
+		layoutLibDirs, layoutBinDirs, layoutProfileDirs, ldconfigPaths = libDirs, binDirs, profileDirs, ldconfigs
+	})
+	layoutLibDirs = []string{filepath.Join(root, "usr/lib64"), filepath.Join(root, "opt/onload/lib64")}
+	layoutBinDirs = []string{filepath.Join(root, "usr/bin"), filepath.Join(root, "opt/onload/bin")}
+	layoutProfileDirs = []string{filepath.Join(root, "usr/libexec/onload/profiles"), filepath.Join(root, "opt/onload/profiles")}
+
+	fixture, err := filepath.Abs("testdata/ldconfig/ldconfig-p.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldconfig := filepath.Join(root, "ldconfig")
+	if err := os.WriteFile(ldconfig, []byte("#!/bin/sh\ncat '"+fixture+"'\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// ldconfig is tried at each path until one runs
+	ldconfigPaths = []string{filepath.Join(root, "missing/ldconfig"), ldconfig}
+}
+
+func TestProbeHostLayout(t *testing.T) {
+	root := t.TempDir()
+	setTestLayout(t, root)
+
+	// nothing installed, but the linker cache has the libraries
+	layout := ProbeHostLayout(context.Background())
+	want := HostLayout{OnloadLibPath: "/opt/onload/lib64", ZfLibPath: "/opt/onload/lib64"}
+	if layout != want {
+		t.Errorf("layout from the linker cache = %+v, want %+v", layout, want)
+	}
+
+	// the known directories are preferred over the linker cache, in order
+	writeTestFiles(t, root,
+		"usr/lib64/libonload.so", "opt/onload/lib64/libonload.so",
+		"opt/onload/lib64/libonload_zf.so",
+		"opt/onload/bin/onload", "usr/bin/zf_stackdump", "opt/onload/bin/zf_stackdump",
+		"opt/onload/profiles/latency.opf",
+	)
+	layout = ProbeHostLayout(context.Background())
+	want = HostLayout{
+		OnloadLibPath:  filepath.Join(root, "usr/lib64"),
+		OnloadBinPath:  filepath.Join(root, "opt/onload/bin"),
+		ProfileDirPath: filepath.Join(root, "opt/onload/profiles"),
+		ZfLibPath:      filepath.Join(root, "opt/onload/lib64"),
+		ZfBinPath:      filepath.Join(root, "usr/bin"),
+	}
+	if layout != want {
+		t.Errorf("layout = %+v, want %+v", layout, want)
+	}
+
+	// without a linker cache, libraries not in the known directories are not found
+	ldconfigPaths = []string{filepath.Join(root, "missing/ldconfig")}
+	if err := os.Remove(filepath.Join(root, "opt/onload/lib64/libonload_zf.so")); err != nil {
+		t.Fatal(err)
+	}
+	if layout := ProbeHostLayout(context.Background()); layout.ZfLibPath != "" {
+		t.Errorf("ZfLibPath = %q without a linker cache, want empty", layout.ZfLibPath)
+	}
+}
+
+func TestWithHostLayout(t *testing.T) {
+	layout := HostLayout{
+		OnloadLibPath:  "/opt/onload/lib64",
+		OnloadBinPath:  "/opt/onload/bin",
+		ProfileDirPath: "/opt/onload/profiles",
+	}
+
+	// only `auto` host paths are resolved, and those not found are disabled
+	config := &OnloadDevicePluginConfig{
+		HostOnloadLibPath:  hostPath_Auto,
+		HostOnloadBinPath:  "/usr/bin",
+		HostProfileDirPath: hostPath_Auto,
+		HostZfLibPath:      hostPath_Auto,
+	}
+	got := config.withHostLayout(layout).hostLayout()
+	want := HostLayout{
+		OnloadLibPath:  "/opt/onload/lib64",
+		OnloadBinPath:  "/usr/bin",
+		ProfileDirPath: "/opt/onload/profiles",
+	}
+	if got != want {
+		t.Errorf("resolved layout = %+v, want %+v", got, want)
+	}
+	if config.HostOnloadLibPath != hostPath_Auto {
+		t.Error("withHostLayout modified its config")
+	}
+
+	// a config without `auto` host paths is returned as is
+	config = &OnloadDevicePluginConfig{HostOnloadLibPath: "/usr/lib64"}
+	if config.withHostLayout(layout) != config {
+		t.Error("withHostLayout copied a config without auto host paths")
+	}
+}
@@ -0,0 +1,210 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/nomad/plugins/device"
+)
+
+// The Nomad Device Plugin API has no "unreserve", so the plugin keeps a ledger of
+// what each Reserve call handed out.  It is persisted to `ledger_path`, if set,
+// so that it survives plugin restarts.  Entries are aged out after `ledger_ttl`.
+// They are not reconciled against the running Tasks, like their cgroups, as the plugin
+// is not told which Tasks hold which reservations.
+
+// ledgerEntry records a single Reserve call
+type ledgerEntry struct {
+	ID          string               `json:"id"`
+	Time        time.Time            `json:"time"`
+	DeviceIDs   []string             `json:"device_ids"`
+	DeviceTypes []string             `json:"device_types"`
+	Interfaces  []string             `json:"interfaces"`
+	OOVersion   string               `json:"onload_version"`
+	ZFVersion   string               `json:"zf_version"`
+	Mounts      []*device.Mount      `json:"mounts"`
+	Devices     []*device.DeviceSpec `json:"devices"`
+	Envs        map[string]string    `json:"envs"`
+}
+
+// ledgerFile is the on-disk format of the ledger
+type ledgerFile struct {
+	Entries []*ledgerEntry `json:"entries"`
+}
+
+// reservationLedger is the record of reservations
+type reservationLedger struct {
+	// path is the file the ledger is persisted to, or empty to keep it in memory
+	path string
+	// ttl is how long entries are kept
+	ttl time.Duration
+
+	entries []*ledgerEntry
+	lock    sync.Mutex
+}
+
+// newReservationLedger returns an empty ledger persisted at path, with entries kept for ttl
+func newReservationLedger(path string, ttl time.Duration) *reservationLedger {
+	return &reservationLedger{
+		path: path,
+		ttl:  ttl,
+	}
+}
+
+// load reads the ledger from its path, dropping expired entries.
+// A missing file is an empty ledger.
+func (l *reservationLedger) load() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.entries = nil
+	if l.path == "" {
+		return nil
+	}
+	ledgerBytes, err := os.ReadFile(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read ledger '%s': %w", l.path, err)
+	}
+
+	var file ledgerFile
+	if err := json.Unmarshal(ledgerBytes, &file); err != nil {
+		return fmt.Errorf("failed to parse ledger '%s': %w", l.path, err)
+	}
+	l.entries = file.Entries
+	l.prune(time.Now())
+	return nil
+}
+
+// record adds a new entry to the ledger, assigning its ID and time, and persists it
+func (l *reservationLedger) record(entry *ledgerEntry) error {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+	entry.ID = id
+	entry.Time = time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, entry)
+	l.prune(entry.Time)
+	return l.save()
+}
+
+// expire drops entries older than the TTL, persisting the ledger if any were dropped
+func (l *reservationLedger) expire() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.prune(time.Now()) {
+		return nil
+	}
+	return l.save()
+}
+
+// Entries returns a copy of the ledger's entries
+func (l *reservationLedger) Entries() []*ledgerEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]*ledgerEntry{}, l.entries...)
+}
+
+// prune drops entries older than the TTL, returning true if any were dropped.
+// The lock must be held.
+func (l *reservationLedger) prune(now time.Time) bool {
+	kept := l.entries[:0]
+	for _, entry := range l.entries {
+		if now.Sub(entry.Time) < l.ttl {
+			kept = append(kept, entry)
+		}
+	}
+	pruned := len(kept) != len(l.entries)
+	l.entries = kept
+	return pruned
+}
+
+// save atomically writes the ledger to its path, by writing a temporary file
+// in the same directory and renaming it.  The lock must be held.
+func (l *reservationLedger) save() error {
+	if l.path == "" {
+		return nil
+	}
+	ledgerBytes, err := json.MarshalIndent(ledgerFile{Entries: l.entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(l.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create ledger directory '%s': %w", dir, err)
+	}
+	tmpFile, err := os.CreateTemp(dir, filepath.Base(l.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create ledger '%s': %w", l.path, err)
+	}
+	defer os.Remove(tmpFile.Name()) // no-op once renamed
+
+	if _, err := tmpFile.Write(ledgerBytes); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write ledger '%s': %w", l.path, err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to sync ledger '%s': %w", l.path, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close ledger '%s': %w", l.path, err)
+	}
+	if err := os.Rename(tmpFile.Name(), l.path); err != nil {
+		return fmt.Errorf("failed to replace ledger '%s': %w", l.path, err)
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// loadLedger loads ledger and makes it the plugin's ledger, restoring the record of
+// reserved devices and Onload versions from its entries.  A ledger that fails to
+// load is logged and started empty, rather than preventing the plugin from starting.
+func (d *OnloadDevicePlugin) loadLedger(ledger *reservationLedger) {
+	if err := ledger.load(); err != nil {
+		d.logger.Error("failed to load reservation ledger, starting empty", "error", err)
+	}
+
+	d.deviceLock.Lock()
+	defer d.deviceLock.Unlock()
+	d.ledger = ledger
+	var latestVersion string
+	var latestTime time.Time
+	for _, entry := range ledger.Entries() {
+		if entry.OOVersion != "" && entry.Time.After(latestTime) {
+			latestVersion, latestTime = entry.OOVersion, entry.Time
+		}
+		for i, deviceID := range entry.DeviceIDs {
+			if entry.Time.After(d.reservedDevices[deviceID]) {
+				d.reservedDevices[deviceID] = entry.Time
+			}
+			if entry.OOVersion != "" && i < len(entry.DeviceTypes) && isOnloadDeviceType(entry.DeviceTypes[i]) &&
+				entry.Time.After(d.reservedVersions[entry.OOVersion]) {
+				d.reservedVersions[entry.OOVersion] = entry.Time
+			}
+		}
+	}
+
+	// the latest reserved Onload version stands in for the last published one,
+	// so that an upgrade while the plugin was stopped is still drained
+	if d.ooVersion == "" {
+		d.ooVersion = latestVersion
+	}
+}
@@ -0,0 +1,189 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/device"
+)
+
+// writeTestLedger writes a ledger file with entries to path
+func writeTestLedger(t *testing.T, path string, entries ...*ledgerEntry) {
+	t.Helper()
+	l := newReservationLedger(path, 0)
+	l.entries = entries
+	if err := l.save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReservationLedgerPersist(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state", "ledger.json")
+
+	l := newReservationLedger(path, time.Hour)
+	for _, id := range []string{"eth0-0", "eth1-0"} {
+		entry := &ledgerEntry{
+			DeviceIDs:   []string{id},
+			DeviceTypes: []string{deviceType_Onload},
+			OOVersion:   "8.1.0",
+			Mounts:      []*device.Mount{{TaskPath: "/usr/lib/libonload.so", HostPath: "/usr/lib64/libonload.so", ReadOnly: true}},
+			Envs:        map[string]string{"EF_NAME": "nomad-" + id},
+		}
+		if err := l.record(entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.ID == "" || entry.Time.IsZero() {
+			t.Errorf("entry ID %q, time %v, want them assigned", entry.ID, entry.Time)
+		}
+	}
+
+	// the temporary file is renamed over the ledger, leaving only it
+	files, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "ledger.json" {
+		t.Errorf("ledger directory has %v, want only ledger.json", files)
+	}
+
+	loaded := newReservationLedger(path, time.Hour)
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	got, want := loaded.Entries(), l.Entries()
+	if len(got) != len(want) {
+		t.Fatalf("loaded %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || !got[i].Time.Equal(want[i].Time) ||
+			!reflect.DeepEqual(got[i].DeviceIDs, want[i].DeviceIDs) ||
+			!reflect.DeepEqual(got[i].Mounts, want[i].Mounts) || !reflect.DeepEqual(got[i].Envs, want[i].Envs) {
+			t.Errorf("loaded entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReservationLedgerTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	now := time.Now()
+	writeTestLedger(t, path,
+		&ledgerEntry{ID: "old", Time: now.Add(-2 * time.Hour)},
+		&ledgerEntry{ID: "aging", Time: now.Add(-50 * time.Minute)},
+		&ledgerEntry{ID: "new", Time: now},
+	)
+
+	// expired entries are dropped when loaded
+	l := newReservationLedger(path, time.Hour)
+	if err := l.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ledgerEntryIDs(l.Entries()); !reflect.DeepEqual(got, []string{"aging", "new"}) {
+		t.Errorf("loaded entries = %v, want aging and new", got)
+	}
+
+	// and when they age out, persisting the ledger
+	if l.prune(now.Add(5 * time.Minute)) {
+		t.Error("pruned entries within the TTL")
+	}
+	l.ttl = 30 * time.Minute
+	if err := l.expire(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ledgerEntryIDs(l.Entries()); !reflect.DeepEqual(got, []string{"new"}) {
+		t.Errorf("expired entries = %v, want new", got)
+	}
+	reloaded := newReservationLedger(path, time.Hour)
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ledgerEntryIDs(reloaded.Entries()); !reflect.DeepEqual(got, []string{"new"}) {
+		t.Errorf("reloaded entries = %v, want new", got)
+	}
+}
+
+func TestReservationLedgerLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	// a missing file, or no path, is an empty ledger
+	for _, path := range []string{filepath.Join(dir, "missing.json"), ""} {
+		l := newReservationLedger(path, time.Hour)
+		if err := l.load(); err != nil {
+			t.Errorf("load(%q) = %v, want no error", path, err)
+		}
+		if len(l.Entries()) != 0 {
+			t.Errorf("load(%q) entries = %v, want none", path, l.Entries())
+		}
+	}
+
+	// a corrupt file is an error, and an empty ledger
+	path := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(path, []byte(`{"entries": [`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := newReservationLedger(path, time.Hour)
+	l.entries = []*ledgerEntry{{ID: "stale", Time: time.Now()}}
+	if err := l.load(); err == nil || !strings.Contains(err.Error(), "failed to parse ledger") {
+		t.Errorf("load of corrupt ledger = %v, want a parse error", err)
+	}
+	if len(l.Entries()) != 0 {
+		t.Errorf("corrupt ledger entries = %v, want none", l.Entries())
+	}
+
+	// which the plugin starts with, rather than failing, and overwrites upon the next reservation
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	d.loadLedger(l)
+	if len(d.reservedDevices) != 0 {
+		t.Errorf("reservedDevices = %v, want none", d.reservedDevices)
+	}
+	if err := d.ledger.record(&ledgerEntry{DeviceIDs: []string{"eth0-0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := newReservationLedger(path, time.Hour).load(); err != nil {
+		t.Errorf("load of rewritten ledger = %v", err)
+	}
+}
+
+func TestLoadLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	now := time.Now()
+	writeTestLedger(t, path,
+		&ledgerEntry{ID: "a", Time: now.Add(-time.Minute), DeviceIDs: []string{"eth0-0", "ptp0-0"},
+			DeviceTypes: []string{deviceType_Onload, deviceType_PTP}, OOVersion: "8.1.0"},
+		&ledgerEntry{ID: "b", Time: now, DeviceIDs: []string{"ptp0-0"},
+			DeviceTypes: []string{deviceType_PTP}, OOVersion: "8.2.0"},
+	)
+
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	d.loadLedger(newReservationLedger(path, time.Hour))
+	if got := d.reservedDevices["ptp0-0"]; !got.Equal(now) {
+		t.Errorf("ptp0-0 reserved at %v, want the latest %v", got, now)
+	}
+	if _, ok := d.reservedDevices["eth0-0"]; !ok {
+		t.Errorf("reservedDevices = %v, want eth0-0", d.reservedDevices)
+	}
+	// only Onload device types reserve an Onload version
+	if _, ok := d.reservedVersions["8.1.0"]; !ok || len(d.reservedVersions) != 1 {
+		t.Errorf("reservedVersions = %v, want only 8.1.0", d.reservedVersions)
+	}
+	if d.ooVersion != "8.2.0" {
+		t.Errorf("ooVersion = %q, want the latest reserved 8.2.0", d.ooVersion)
+	}
+}
+
+// ledgerEntryIDs returns the IDs of entries
+func ledgerEntryIDs(entries []*ledgerEntry) []string {
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
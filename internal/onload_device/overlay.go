@@ -0,0 +1,180 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/hcl"
+	"github.com/kr/pretty"
+)
+
+// The overlay config file (`overlay_config_path`) holds the settings that are safe to
+// change at runtime, in HCL or JSON.  It is applied over the plugin config from the
+// Nomad client, and is watched, so changes take effect without restarting the agent.
+// A set value replaces the plugin config's value, including lists and maps.
+// A config that fails to load is logged, keeping the previous config.
+
+// overlayConfig is the format of the overlay config file.  Unset settings are nil.
+type overlayConfig struct {
+	IgnoredInterfaces *[]string          `hcl:"ignored_interfaces"`
+	DeviceTypes       *[]string          `hcl:"device_types"`
+	ModuleParameters  *[]string          `hcl:"module_parameters"`
+	NumNIC            *string            `hcl:"num_nic"`
+	NumNICAuto        *bool              `hcl:"num_nic_auto"`
+	StackVIs          *int               `hcl:"stack_vis"`
+	StackPktBufs      *int               `hcl:"stack_pkt_bufs"`
+	NumPsuedoPPS      *int               `hcl:"num_pps"`
+	NumPsuedoPTP      *int               `hcl:"num_ptp"`
+	Attributes        *map[string]string `hcl:"attributes"`
+}
+
+// overlayConfigKeys are the settings allowed in the overlay config file
+var overlayConfigKeys = []string{
+	"ignored_interfaces", "device_types", "module_parameters",
+	"num_nic", "num_nic_auto", "stack_vis", "stack_pkt_bufs", "num_pps", "num_ptp",
+	"attributes",
+}
+
+// parseOverlayConfig parses the overlay config from src, rejecting settings that may not be overlaid
+func parseOverlayConfig(src string) (*overlayConfig, error) {
+	var keys map[string]interface{}
+	if err := hcl.Decode(&keys, src); err != nil {
+		return nil, err
+	}
+	var unknownKeys []string
+	for key := range keys {
+		if !slices.Contains(overlayConfigKeys, key) {
+			unknownKeys = append(unknownKeys, key)
+		}
+	}
+	if len(unknownKeys) != 0 {
+		sort.Strings(unknownKeys)
+		return nil, fmt.Errorf("settings %q may not be overlaid, only %q", unknownKeys, overlayConfigKeys)
+	}
+
+	var overlay overlayConfig
+	if err := hcl.Decode(&overlay, src); err != nil {
+		return nil, err
+	}
+	return &overlay, nil
+}
+
+// apply returns a copy of base with the overlay's settings applied
+func (o *overlayConfig) apply(base OnloadDevicePluginConfig) *OnloadDevicePluginConfig {
+	config := base
+	if o.IgnoredInterfaces != nil {
+		config.IgnoredInterfaces = *o.IgnoredInterfaces
+	}
+	if o.DeviceTypes != nil {
+		config.DeviceTypes = *o.DeviceTypes
+	}
+	if o.ModuleParameters != nil {
+		config.ModuleParameters = *o.ModuleParameters
+	}
+	if o.NumNIC != nil {
+		config.NumNICSetting = *o.NumNIC
+	}
+	if o.NumNICAuto != nil {
+		config.NumNICAutoSetting = *o.NumNICAuto
+	}
+	if o.NumNIC != nil || o.NumNICAuto != nil {
+		config.resolveNumNIC()
+	}
+	if o.StackVIs != nil {
+		config.StackVIs = *o.StackVIs
+	}
+	if o.StackPktBufs != nil {
+		config.StackPktBufs = *o.StackPktBufs
+	}
+	if o.NumPsuedoPPS != nil {
+		config.NumPsuedoPPS = *o.NumPsuedoPPS
+	}
+	if o.NumPsuedoPTP != nil {
+		config.NumPsuedoPTP = *o.NumPsuedoPTP
+	}
+	if o.Attributes != nil {
+		config.Attributes = *o.Attributes
+	}
+	return &config
+}
+
+// loadOverlayConfig returns base with the overlay config file at path applied,
+// along with any validation warnings.  A missing file is no overlay, so base is returned as is.
+func loadOverlayConfig(path string, base OnloadDevicePluginConfig) (*OnloadDevicePluginConfig, []string, error) {
+	srcBytes, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &base, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to read overlay config '%s': %w", path, err)
+	}
+	overlay, err := parseOverlayConfig(string(srcBytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse overlay config '%s': %w", path, err)
+	}
+	config := overlay.apply(base)
+	warnings, errs := config.validateRuntimeSettings()
+	if len(errs) != 0 {
+		return nil, warnings, fmt.Errorf("invalid overlay config '%s': %w", path, errors.Join(errs...))
+	}
+	return config, warnings, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// reloadOverlayConfig loads the overlay config file and, if it changes the config,
+// makes it the current config, returning true.  A config that fails to load is logged
+// and the previous config is kept.
+func (d *OnloadDevicePlugin) reloadOverlayConfig() bool {
+	d.overlayLock.Lock()
+	defer d.overlayLock.Unlock()
+	return d.applyOverlayConfig()
+}
+
+// applyOverlayConfig is reloadOverlayConfig, with overlayLock held, so that the base and
+// current configs do not change between reading them and replacing the current one.
+func (d *OnloadDevicePlugin) applyOverlayConfig() bool {
+	d.configLock.RLock()
+	base, current := d.baseConfig, d.config
+	d.configLock.RUnlock()
+
+	path := base.OverlayConfigPath
+	config, warnings, err := loadOverlayConfig(path, base)
+	for _, warning := range warnings {
+		d.logger.Warn("questionable overlay config", "path", path, "warning", warning)
+	}
+	if err != nil {
+		d.logger.Error("failed to load overlay config, keeping the previous config", "path", path, "error", err)
+		return false
+	}
+	if reflect.DeepEqual(config, current) {
+		return false
+	}
+	d.setConfig(config)
+	d.logger.Info("overlay config applied", "path", path, "config", log.Fmt("% #v", pretty.Formatter(config)))
+	return true
+}
+
+// watchOverlayConfig reloads the overlay config whenever its file changes, triggering a
+// fingerprint if the config changed.  The file's directory is watched, rather than the file,
+// so that files replaced by renaming, as editors and config management tools do, are seen.
+func (d *OnloadDevicePlugin) watchOverlayConfig(ctx context.Context, path string) {
+	watchPath(ctx, d.logger, filepath.Dir(path), func(name string) {
+		if name != "" && filepath.Clean(name) != filepath.Clean(path) {
+			return // another file in the directory
+		}
+		if d.reloadOverlayConfig() {
+			d.triggerFingerprint()
+		}
+	})
+}
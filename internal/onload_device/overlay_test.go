@@ -0,0 +1,181 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+func TestParseOverlayConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    *overlayConfig
+		wantErr string
+	}{
+		{
+			name: "empty",
+			src:  "",
+			want: &overlayConfig{},
+		},
+		{
+			name: "settings",
+			src: `
+num_nic = 4
+device_types = ["onload"]
+attributes {
+  rack = "r12"
+}`,
+			want: &overlayConfig{
+				NumNIC:      pointerTo("4"),
+				DeviceTypes: pointerTo([]string{"onload"}),
+				Attributes:  pointerTo(map[string]string{"rack": "r12"}),
+			},
+		},
+		{
+			name: "json",
+			src:  `{"num_pps": 2, "attributes": {"rack": "r12"}}`,
+			want: &overlayConfig{
+				NumPsuedoPPS: pointerTo(2),
+				Attributes:   pointerTo(map[string]string{"rack": "r12"}),
+			},
+		},
+		{
+			name:    "not overlayable",
+			src:     "num_nic = 4\ntask_prefix = \"/opt\"\nledger_path = \"/tmp/l\"\n",
+			wantErr: `settings ["ledger_path" "task_prefix"] may not be overlaid`,
+		},
+		{
+			name:    "malformed",
+			src:     "num_nic = [",
+			wantErr: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overlay, err := parseOverlayConfig(tt.src)
+			if tt.want == nil {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(overlay, tt.want) {
+				t.Errorf("overlay = %+v, want %+v", overlay, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlayConfigApply(t *testing.T) {
+	base := OnloadDevicePluginConfig{
+		NumPsuedoNIC: 10,
+		NumPsuedoPPS: 1,
+		DeviceTypes:  []string{"onload", "zf"},
+		Attributes:   map[string]string{"rack": "r1", "row": "a"},
+	}
+	overlay := &overlayConfig{
+		NumNIC:      pointerTo("0"),
+		DeviceTypes: pointerTo([]string{"onload"}),
+		Attributes:  pointerTo(map[string]string{"rack": "r2"}),
+	}
+	config := overlay.apply(base)
+	if config.NumPsuedoNIC != 0 || config.NumPsuedoPPS != 1 {
+		t.Errorf("num_nic, num_pps = %d, %d, want 0, 1", config.NumPsuedoNIC, config.NumPsuedoPPS)
+	}
+	if !reflect.DeepEqual(config.DeviceTypes, []string{"onload"}) {
+		t.Errorf("device_types = %v, want [onload]", config.DeviceTypes)
+	}
+	// maps are replaced, not merged
+	if !reflect.DeepEqual(map[string]string(config.Attributes), map[string]string{"rack": "r2"}) {
+		t.Errorf("attributes = %v, want only rack", config.Attributes)
+	}
+	if base.NumPsuedoNIC != 10 {
+		t.Error("apply modified base")
+	}
+
+	// num_nic may switch to and from auto
+	config = (&overlayConfig{NumNIC: pointerTo(numNIC_Auto)}).apply(*config)
+	if !config.NumPsuedoNICAuto || config.NumPsuedoNIC != numNIC_AutoFallback {
+		t.Errorf("num_nic auto = %v, %d, want auto with %d", config.NumPsuedoNICAuto, config.NumPsuedoNIC, numNIC_AutoFallback)
+	}
+	config = (&overlayConfig{NumNIC: pointerTo("4")}).apply(*config)
+	if config.NumPsuedoNICAuto || config.NumPsuedoNIC != 4 {
+		t.Errorf("num_nic 4 = %v, %d, want 4", config.NumPsuedoNICAuto, config.NumPsuedoNIC)
+	}
+}
+
+func TestReloadOverlayConfig(t *testing.T) {
+	dir := t.TempDir()
+	overlayPath := filepath.Join(dir, "overlay.hcl")
+	writeOverlay := func(src string) {
+		t.Helper()
+		if err := os.WriteFile(overlayPath, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	base := OnloadDevicePluginConfig{
+		NumPsuedoNIC:      10,
+		DeviceTypes:       []string{"onload"},
+		OverlayConfigPath: overlayPath,
+	}
+	d.baseConfig = base
+	d.setConfig(&base)
+
+	// a missing file is no overlay, which changes nothing
+	if d.reloadOverlayConfig() {
+		t.Error("missing overlay changed the config")
+	}
+
+	writeOverlay("num_nic = 4\n")
+	if !d.reloadOverlayConfig() {
+		t.Error("overlay did not change the config")
+	}
+	if got := d.getConfig().NumPsuedoNIC; got != 4 {
+		t.Errorf("num_nic = %d, want 4", got)
+	}
+
+	// reloading the same overlay is a no-op
+	writeOverlay("num_nic = 4 # unchanged\n")
+	if d.reloadOverlayConfig() {
+		t.Error("unchanged overlay changed the config")
+	}
+
+	// invalid overlays keep the previous config
+	for _, src := range []string{"num_nic = -1\n", "num_nic = \"many\"\n", "task_prefix = \"/opt\"\n", "num_nic = [\n"} {
+		writeOverlay(src)
+		if d.reloadOverlayConfig() {
+			t.Errorf("invalid overlay %q changed the config", src)
+		}
+		if got := d.getConfig().NumPsuedoNIC; got != 4 {
+			t.Errorf("num_nic = %d after invalid overlay %q, want 4", got, src)
+		}
+	}
+
+	// removing the overlay restores the base config
+	if err := os.Remove(overlayPath); err != nil {
+		t.Fatal(err)
+	}
+	if !d.reloadOverlayConfig() {
+		t.Error("removed overlay did not change the config")
+	}
+	if got := d.getConfig().NumPsuedoNIC; got != 10 {
+		t.Errorf("num_nic = %d, want the base 10", got)
+	}
+}
+
+func pointerTo[T any](v T) *T {
+	return &v
+}
@@ -5,11 +5,14 @@ package onload_device
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/nomad/plugins/base"
 	"github.com/hashicorp/nomad/plugins/device"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
@@ -48,11 +51,34 @@ const (
 	groupName_NotAvailable = "NA"
 	deviceName_None        = "none"
 
+	// device ID sources, per `device_id_source`
+	deviceIDSource_Interface = "interface"
+	deviceIDSource_PCI       = "pci"
+
 	// attribute names
 	attr_OnloadVersion = "onload_version"
 	attr_ZFVersion     = "zf_version"
+	attr_Interface     = "interface"
+	// the Host's Onload and TCPDirect paths, with `auto` ones resolved
+	attr_OnloadLibPath  = "onload_lib_path"
+	attr_OnloadBinPath  = "onload_bin_path"
+	attr_ProfileDirPath = "onload_profile_dir_path"
+	attr_ZfLibPath      = "zf_lib_path"
+	attr_ZfBinPath      = "zf_bin_path"
+	// attr_OnloadProfiles is the comma-separated names of the Host's Onload profiles
+	attr_OnloadProfiles = "onload_profiles"
+	// attr_ModuleParamPrefix prefixes kernel module parameter attributes,
+	// like "modparam_onload_max_layer2_interfaces"
+	attr_ModuleParamPrefix = "modparam_"
 )
 
+// builtinAttributes are the attribute names published by the plugin, besides module parameters
+var builtinAttributes = []string{
+	attr_OnloadVersion, attr_ZFVersion, attr_Interface,
+	attr_OnloadLibPath, attr_OnloadBinPath, attr_ProfileDirPath, attr_ZfLibPath, attr_ZfBinPath,
+	attr_OnloadProfiles,
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 type configDesc struct {
@@ -66,29 +92,117 @@ type configDesc struct {
 
 // Config contains configuration information for the plugin.
 type OnloadDevicePluginConfig struct {
-	SetPreload         bool     `codec:"set_preload"`
-	ProbeSFC           bool     `codec:"probe_nic"`
-	ProbeXDP           bool     `codec:"probe_xdp"`
-	ProbePTP           bool     `codec:"probe_ptp"`
-	ProbePPS           bool     `codec:"probe_pps"`
-	MountOnload        bool     `codec:"mount_onload"`
-	NumPsuedoNIC       int      `codec:"num_nic"`
-	NumPsuedoPPS       int      `codec:"num_pps"`
-	NumPsuedoPTP       int      `codec:"num_ptp"`
-	IgnoredInterfaces  []string `codec:"ignored_interfaces"`
-	TaskDevicePath     string   `codec:"task_device_path"`
-	HostDevicePath     string   `codec:"host_device_path"`
-	TaskOnloadBinPath  string   `codec:"task_onload_bin_path"`
-	HostOnloadBinPath  string   `codec:"host_onload_bin_path"`
-	TaskOnloadLibPath  string   `codec:"task_onload_lib_path"`
-	HostOnloadLibPath  string   `codec:"host_onload_lib_path"`
-	TaskProfileDirPath string   `codec:"task_profile_dir_path"`
-	HostProfileDirPath string   `codec:"host_profile_dir_path"`
-	TaskZfBinPath      string   `codec:"task_zf_bin_path"`
-	HostZfBinPath      string   `codec:"host_zf_bin_path"`
-	TaskZfLibPath      string   `codec:"task_zf_lib_path"`
-	HostZfLibPath      string   `codec:"host_zf_lib_path"`
-	FingerprintPeriod  string   `codec:"fingerprint_period"`
+	SetPreload          bool       `codec:"set_preload"`
+	ProbeSFC            bool       `codec:"probe_nic"`
+	ProbeXDP            bool       `codec:"probe_xdp"`
+	ProbePTP            bool       `codec:"probe_ptp"`
+	ProbePPS            bool       `codec:"probe_pps"`
+	MountOnload         bool       `codec:"mount_onload"`
+	NumNICSetting       string     `codec:"num_nic"`      // a count, or "auto"
+	NumNICAutoSetting   bool       `codec:"num_nic_auto"` // resolved with num_nic
+	NumPsuedoNIC        int        `codec:"-"`            // resolved count, or fallback count with NumPsuedoNICAuto
+	NumPsuedoNICAuto    bool       `codec:"-"`            // resolved auto-sizing
+	StackVIs            int        `codec:"stack_vis"`
+	StackPktBufs        int        `codec:"stack_pkt_bufs"`
+	NumPsuedoPPS        int        `codec:"num_pps"`
+	NumPsuedoPTP        int        `codec:"num_ptp"`
+	DeviceTypes         []string   `codec:"device_types"`
+	IgnoredInterfaces   []string   `codec:"ignored_interfaces"`
+	DeviceIDSource      string     `codec:"device_id_source"`
+	ModuleParameters    []string   `codec:"module_parameters"`
+	TaskDevicePath      string     `codec:"task_device_path"`
+	HostDevicePath      string     `codec:"host_device_path"`
+	TaskOnloadBinPath   string     `codec:"task_onload_bin_path"`
+	HostOnloadBinPath   string     `codec:"host_onload_bin_path"`
+	TaskOnloadLibPath   string     `codec:"task_onload_lib_path"`
+	HostOnloadLibPath   string     `codec:"host_onload_lib_path"`
+	TaskProfileDirPath  string     `codec:"task_profile_dir_path"`
+	HostProfileDirPath  string     `codec:"host_profile_dir_path"`
+	TaskZfBinPath       string     `codec:"task_zf_bin_path"`
+	HostZfBinPath       string     `codec:"host_zf_bin_path"`
+	TaskZfLibPath       string     `codec:"task_zf_lib_path"`
+	HostZfLibPath       string     `codec:"host_zf_lib_path"`
+	FingerprintPeriod   string     `codec:"fingerprint_period"`
+	UpgradeDrainPeriod  string     `codec:"upgrade_drain_period"`
+	RemovedTimeout      string     `codec:"removed_device_timeout"`
+	DrainDir            string     `codec:"drain_dir"`
+	LedgerPath          string     `codec:"ledger_path"`
+	LedgerTTL           string     `codec:"ledger_ttl"`
+	ProbeTimeout        string     `codec:"probe_timeout"`
+	ProbeStalePeriod    string     `codec:"probe_stale_period"`
+	ProbeBackoff        string     `codec:"probe_backoff"`
+	ProbeBackoffMax     string     `codec:"probe_backoff_max"`
+	RestrictInterfaces  []string   `codec:"restrict_interfaces"`
+	ELFDependencies     bool       `codec:"elf_dependencies"`
+	ELFExcludeLibraries []string   `codec:"elf_exclude_libraries"`
+	OverlayConfigPath   string     `codec:"overlay_config_path"`
+	Attributes          hclMap     `codec:"attributes"`
+	DeviceTypeEnv       hclEnvMaps `codec:"device_type_env"`
+	InterfaceEnv        hclEnvMaps `codec:"interface_env"`
+	ProfileDeviceTypes  []string   `codec:"profile_device_types"`
+	SetStackName        bool       `codec:"set_stack_name"`
+	StackNamePrefix     string     `codec:"stack_name_prefix"`
+	PreloadPolicy       string     `codec:"preload_policy"`
+	PreloadLibraries    []string   `codec:"preload_libraries"`
+	PreloadMode         string     `codec:"preload_mode"`
+	PreloadFileDir      string     `codec:"preload_file_dir"`
+	TaskPrefix          string     `codec:"task_prefix"`
+	TaskPrefixPathEnv   string     `codec:"task_prefix_path_env"`
+}
+
+// Nomad parses the plugin config with HCL1, which decodes each map as a list of maps,
+// one per block or assignment, so map settings are declared as lists of maps, and
+// merged into one map when decoded, like Nomad's hclutils.MapStrStr.
+
+// hclMap is a map of strings, declared as `list(map(string))`
+type hclMap map[string]string
+
+func (m *hclMap) CodecEncodeSelf(enc *codec.Encoder) {
+	enc.MustEncode([]map[string]string{*m})
+}
+
+func (m *hclMap) CodecDecodeSelf(dec *codec.Decoder) {
+	var maps []map[string]string
+	dec.MustDecode(&maps)
+
+	r := make(map[string]string)
+	for _, values := range maps {
+		for key, value := range values {
+			r[key] = value
+		}
+	}
+	*m = r
+}
+
+// hclEnvMaps is a map of environment variables per key, declared as `list(map(list(map(string))))`
+type hclEnvMaps map[string]map[string]string
+
+func (m *hclEnvMaps) CodecEncodeSelf(enc *codec.Encoder) {
+	lists := make(map[string][]map[string]string, len(*m))
+	for key, envs := range *m {
+		lists[key] = []map[string]string{envs}
+	}
+	enc.MustEncode([]map[string][]map[string]string{lists})
+}
+
+func (m *hclEnvMaps) CodecDecodeSelf(dec *codec.Decoder) {
+	var lists []map[string][]map[string]string
+	dec.MustDecode(&lists)
+
+	r := make(map[string]map[string]string)
+	for _, keys := range lists {
+		for key, envsList := range keys {
+			if r[key] == nil {
+				r[key] = make(map[string]string)
+			}
+			for _, envs := range envsList {
+				for name, value := range envs {
+					r[key][name] = value
+				}
+			}
+		}
+	}
+	*m = r
 }
 
 var (
@@ -104,27 +218,58 @@ var (
 	// Config Defaults are stored here
 	configDescriptions = []configDesc{
 		{"set_preload", "bool", false, `true`, "Should the Device Plugin set the LD_PRELOAD environment variable in the Nomad Task?"},
+		{"preload_policy", "string", false, `"prepend"`, "Composition of Onload's preload with `preload_libraries`: `prepend` Onload, `append` Onload, or `replace` them with Onload"},
+		{"preload_libraries", "list(string)", false, `[]`, "List of Task paths of extra libraries to preload, like the image's own `LD_PRELOAD`, which the Task's replaces"},
+		{"preload_mode", "string", false, `"env"`, "How libraries are preloaded: `env` sets `LD_PRELOAD`, and `ld_so_preload` mounts a generated `/etc/ld.so.preload`, which also reaches programs resetting their environment"},
+		{"preload_file_dir", "string", false, `"/var/lib/nomad-onload/preload"`, "Host directory of the generated `ld.so.preload` files, with `preload_mode = \"ld_so_preload\"`"},
+		{"set_stack_name", "bool", false, `false`, "Should the Device Plugin set EF_NAME in the Nomad Task, naming its Onload stacks after its reserved pseudo-device?"},
+		{"stack_name_prefix", "string", false, `""`, "With `set_stack_name`, prefix of the Onload stack name, before the pseudo-device ID"},
 		{"probe_nic", "bool", false, `true`, "Should the Device Plugin probe for Onload-enabled NICs?"},
 		{"probe_pps", "bool", false, `true`, "Should the Device Plugin probe for PPS devices?"},
 		{"probe_ptp", "bool", false, `true`, "Should the Device Plugin probe for PTP devices?"},
 		{"mount_onload", "bool", false, `true`, "Should the Device Plugin mount Onload files into the Nomad Task?"},
-		{"num_nic", "number", false, `10`, "Number of psuedo-devices per NIC device, limiting the number of simultaneous Onloaded Jobs"},
+		{"num_nic", "string", false, `"10"`, "Number of psuedo-devices per NIC device, limiting the number of simultaneous Onloaded Jobs, or `auto` to derive it from the NIC's available VIs and packet buffers, falling back to 10 when unavailable"},
+		{"num_nic_auto", "bool", false, `false`, "Should the number of psuedo-devices per NIC device be derived from its available VIs and packet buffers?  Falls back to the `num_nic` count when unavailable"},
+		{"stack_vis", "number", false, `1`, "With `num_nic_auto`, the number of VIs budgeted per Onload stack.  Zero ignores VIs"},
+		{"stack_pkt_bufs", "number", false, `32768`, "With `num_nic_auto`, the number of packet buffers budgeted per Onload stack.  Zero ignores packet buffers"},
 		{"num_pps", "number", false, `10`, "Number of psuedo-devices per PPS device, limiting the number of simultaneous PPS device claims"},
 		{"num_ptp", "number", false, `10`, "Number of psuedo-devices per PTP device, limiting the number of simultaneous PTP device claims"},
+		{"device_types", "list(string)", false, `["onload", "zf", "onloadzf"]`, "List of Onload/TCPDirect device types to publish, when supported by the installed software"},
+		{"profile_device_types", "list(string)", false, `[]`, "List of globs of Onload profiles to publish as device types like `onload-latency`, whose Tasks get the profile's settings"},
 		{"ignored_interfaces", "list(string)", false, `[]`, "List of interfaces to ignore.  Include `none` to prevent that pseudo-devices creation"},
+		{"module_parameters", "list(string)", false, `["onload/max_layer2_interfaces"]`, "List of `<module>/<parameter>` kernel module parameters to publish as attributes of Onload devices.  The module and parameter may be globs, like `sfc_resource/*` or `sfc*/rss_cpus`"},
+		{"device_id_source", "string", false, `"interface"`, "Source of pseudo-device IDs and models: `interface` for the interface name, or `pci` for the PCI bus address (or MAC address if not PCI), which survives interface renames"},
 		{"task_device_path", "string", false, `"/dev"`, "Path to place device files in the Nomad Task"},
 		{"host_device_path", "string", false, `"/dev"`, "Path to find device files on the Host"},
 		{"task_onload_lib_path", "string", false, `"/usr/lib/x86_64-linux-gnu"`, "Path to place Onload libraries in the Nomad Task"},
-		{"host_onload_lib_path", "string", false, `"/usr/lib/x86_64-linux-gnu"`, "Path to find Onload libraries on the Host"},
+		{"host_onload_lib_path", "string", false, `"/usr/lib/x86_64-linux-gnu"`, "Path to find Onload libraries on the Host.  `auto` discovers it"},
 		{"task_onload_bin_path", "string", false, `"/usr/bin"`, "Path to place Onload binaries in the Nomad Task"},
-		{"host_onload_bin_path", "string", false, `"/usr/bin"`, "Path to find Onload binaries on the Host"},
+		{"host_onload_bin_path", "string", false, `"/usr/bin"`, "Path to find Onload binaries on the Host.  `auto` discovers it"},
 		{"task_profile_dir_path", "string", false, `"/usr/libexec/onload/profiles"`, "Path to place Onload profiles directory in the Nomad Task"},
-		{"host_profile_dir_path", "string", false, `"/usr/libexec/onload/profiles"`, "Path to find Onload profiles directory on the Host"},
+		{"host_profile_dir_path", "string", false, `"/usr/libexec/onload/profiles"`, "Path to find Onload profiles directory on the Host.  `auto` discovers it"},
 		{"task_zf_bin_path", "string", false, `"/usr/bin"`, "Path to place TCPDirect/ZF binaries in the Nomad Task"},
-		{"host_zf_bin_path", "string", false, `"/usr/bin"`, "Path to find TCPDirect/ZF binaries on the Host"},
+		{"host_zf_bin_path", "string", false, `"/usr/bin"`, "Path to find TCPDirect/ZF binaries on the Host.  `auto` discovers it"},
 		{"task_zf_lib_path", "string", false, `"/usr/lib/x86_64-linux-gnu"`, "Path to place TCPDirect/ZF libraries in the Nomad Task"},
-		{"host_zf_lib_path", "string", false, `"/usr/lib/x86_64-linux-gnu"`, "Path to find TCPDirect/ZF libraries on the Host"},
+		{"host_zf_lib_path", "string", false, `"/usr/lib/x86_64-linux-gnu"`, "Path to find TCPDirect/ZF libraries on the Host.  `auto` discovers it"},
+		{"task_prefix", "string", false, `""`, "Task path under which all Onload and TCPDirect files are mounted, like `/opt/nomad-onload`, rather than at the `task_*_path` settings.  Empty disables it"},
+		{"task_prefix_path_env", "string", false, `"/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"`, "With `task_prefix`, the Task's `PATH` after `<task_prefix>/bin`, as it replaces the image's"},
 		{"fingerprint_period", "string", false, `"1m"`, "Period of time between attemps to fingerpint devices"},
+		{"removed_device_timeout", "string", false, `"1h"`, "Period of time that reserved devices which disappeared remain published as unhealthy"},
+		{"drain_dir", "string", false, `"/etc/nomad-onload/drain"`, "Directory of operator drain files.  Devices of an interface with a file named after it are marked unhealthy"},
+		{"ledger_path", "string", false, `""`, "Path of the file persisting the reservation ledger.  Empty keeps it only in memory"},
+		{"ledger_ttl", "string", false, `"168h"`, "Period of time that reservations are kept in the ledger"},
+		{"probe_timeout", "string", false, `"10s"`, "Maximum duration of each probe, like `onload --version` or `lshw`"},
+		{"probe_stale_period", "string", false, `"5m"`, "Period of time that the last successful result of a failing probe is used, after which its devices are unhealthy"},
+		{"probe_backoff", "string", false, `"5s"`, "Initial delay before retrying a failing probe, doubling upon each failure"},
+		{"probe_backoff_max", "string", false, `"5m"`, "Maximum delay before retrying a failing probe"},
+		{"upgrade_drain_period", "string", false, `"0s"`, "Period of time to mark Onload devices unhealthy after an Onload upgrade, if Tasks reserved the old version.  Zero disables it"},
+		{"restrict_interfaces", "list(string)", false, `[]`, "List of device types whose Tasks are only accelerated on their reserved interfaces, using `EF_INTERFACE_WHITELIST`"},
+		{"elf_dependencies", "bool", false, `false`, "Should the Device Plugin mount the shared libraries needed by the mounted Onload and TCPDirect files, per their ELF dependencies?  These may shadow the Task image's libraries"},
+		{"elf_exclude_libraries", "list(string)", false, `["ld-linux*", "libc.so.*", "libm.so.*", "libdl.so.*", "libpthread.so.*", "librt.so.*", "libresolv.so.*", "libgcc_s.so.*", "libstdc++.so.*"]`, "List of globs of shared libraries not to mount with `elf_dependencies`, as the Task image provides them"},
+		{"attributes", "list(map(string))", false, `[]`, "Extra attributes to publish on every device group, like `rack = \"r12\"`"},
+		{"device_type_env", "list(map(list(map(string))))", false, `[]`, "Map of device types to environment variables set in their Tasks, like `EF_POLL_USEC`.  Values are templates of the reserved device"},
+		{"interface_env", "list(map(list(map(string))))", false, `[]`, "Map of interfaces to environment variables set in their Tasks, overriding `device_type_env`.  Values are templates of the reserved device"},
+		{"overlay_config_path", "string", false, `""`, "Path of an HCL or JSON file overriding runtime-safe settings, which is watched and reloaded upon change.  Empty disables it"},
 	}
 )
 
@@ -134,19 +279,78 @@ var (
 type OnloadDevicePlugin struct {
 	logger log.Logger
 
-	// these are local copies of the config values that we need for operation
-	config OnloadDevicePluginConfig
+	// config is the current config, which is baseConfig with the overlay config applied.
+	// It is replaced, never modified, so snapshots from getConfig may be used without the lock.
+	config     *OnloadDevicePluginConfig
+	baseConfig OnloadDevicePluginConfig
+	configLock sync.RWMutex
+
+	// overlayLock serializes applying the overlay config over baseConfig
+	overlayLock sync.Mutex
 
 	// fingerprintPeriod the period for the fingerprinting loop
 	// most plugins that fingerprint in a polling loop will have this
+	// It and the other settings parsed by SetConfig are set under configLock.
 	fingerprintPeriod time.Duration
 
-	// ignoredInterfaces is a set of Interfaces that would not be exposed to Nomad
+	// probes runs the fingerprint probes, with their timeout and last successful results
+	probes *probeRunner
+
+	// removedTimeout is how long reserved devices that disappeared remain published
+	removedTimeout time.Duration
+
+	// upgradeDrainPeriod is how long Onload devices are drained after an Onload upgrade
+	upgradeDrainPeriod time.Duration
+
+	// ignoredInterfaces is a set of Interfaces that would not be exposed to Nomad.
+	// It is rebuilt with config, under configLock.
 	ignoredInterfaces map[string]string
 
+	// fingerprintTrigger requests an immediate fingerprint
+	fingerprintTrigger chan struct{}
+
 	// devices is a list of fingerprinted devices
 	devices    map[string]*FingerprintDeviceData
 	deviceLock sync.RWMutex
+
+	// fingerprintLines and fingerprintHash are the canonical form of the last published fingerprint
+	fingerprintLines []string
+	fingerprintHash  [sha256.Size]byte
+
+	// ooVersion and zfVersion are the versions of the last published fingerprint
+	ooVersion string
+	zfVersion string
+
+	// elfDeps caches the ELF dependencies of mounted files, for elfDepsVersion
+	elfDeps        map[string][]string
+	elfDepsVersion string
+	elfDepsLock    sync.Mutex
+
+	// hostLayout is the Host's Onload and TCPDirect paths of the last fingerprint,
+	// resolving the `auto` host path settings for Reserve
+	hostLayout HostLayout
+
+	// nicCounts maps NIC stable keys to their highest `num_nic_auto` pseudo-device count,
+	// for the stack budgets of nicCountsBudget
+	nicCounts       map[string]int
+	nicCountsBudget [2]int
+
+	// reservedVersions maps Onload versions to when they were last reserved
+	reservedVersions map[string]time.Time
+
+	// reservedDevices maps pseudo-device IDs to when they were last reserved
+	reservedDevices map[string]time.Time
+
+	// removedDevices maps reserved pseudo-device IDs that disappeared to when they did
+	removedDevices map[string]time.Time
+
+	// ledger records every reservation
+	ledger *reservationLedger
+
+	// upgradeDrainUntil is when the drain following an Onload upgrade ends,
+	// with upgradeDrainDesc describing it
+	upgradeDrainUntil time.Time
+	upgradeDrainDesc  string
 }
 
 // NewPlugin returns a device plugin, used primarily by the main wrapper
@@ -155,9 +359,17 @@ type OnloadDevicePlugin struct {
 // a limit to the initialization that can be performed at this point.
 func NewOnloadDevicePlugin(log log.Logger) *OnloadDevicePlugin {
 	return &OnloadDevicePlugin{
-		logger:            log.Named(pluginName),
-		ignoredInterfaces: make(map[string]string),
-		devices:           make(map[string]*FingerprintDeviceData),
+		logger:             log.Named(pluginName),
+		config:             &OnloadDevicePluginConfig{},
+		ignoredInterfaces:  make(map[string]string),
+		fingerprintTrigger: make(chan struct{}, 1),
+		devices:            make(map[string]*FingerprintDeviceData),
+		reservedVersions:   make(map[string]time.Time),
+		reservedDevices:    make(map[string]time.Time),
+		removedDevices:     make(map[string]time.Time),
+		elfDeps:            make(map[string][]string),
+		nicCounts:          make(map[string]int),
+		ledger:             newReservationLedger("", 0),
 	}
 }
 
@@ -205,36 +417,83 @@ func (d *OnloadDevicePlugin) SetConfig(c *base.Config) error {
 		return err
 	}
 
-	// save the configuration to the plugin
-	d.config = config
+	// validate the whole config, reporting all of its problems at once
+	config.resolveNumNIC()
+	warnings, errs := config.validate()
 
-	// Fixup NumPsuedoDevices
-	if d.config.NumPsuedoNIC < 0 {
-		d.config.NumPsuedoNIC = 0
+	// convert the durations from HCL strings into time.Durations
+	period := parseConfigDuration(&errs, "fingerprint_period", config.FingerprintPeriod, false)
+	drainPeriod := parseConfigDuration(&errs, "upgrade_drain_period", config.UpgradeDrainPeriod, true)
+	removedTimeout := parseConfigDuration(&errs, "removed_device_timeout", config.RemovedTimeout, true)
+	ledgerTTL := parseConfigDuration(&errs, "ledger_ttl", config.LedgerTTL, false)
+	probeTimeout := parseConfigDuration(&errs, "probe_timeout", config.ProbeTimeout, false)
+	probeStalePeriod := parseConfigDuration(&errs, "probe_stale_period", config.ProbeStalePeriod, true)
+	probeBackoff := parseConfigDuration(&errs, "probe_backoff", config.ProbeBackoff, false)
+	probeBackoffMax := parseConfigDuration(&errs, "probe_backoff_max", config.ProbeBackoffMax, false)
+	if probeBackoffMax < probeBackoff {
+		errs = append(errs, fmt.Errorf("probe_backoff_max: must be at least probe_backoff %q, got %q", config.ProbeBackoff, config.ProbeBackoffMax))
 	}
-	if d.config.NumPsuedoPPS < 0 {
-		d.config.NumPsuedoPPS = 0
-	}
-	if d.config.NumPsuedoPTP < 0 {
-		d.config.NumPsuedoPTP = 0
+	if period > 0 && probeTimeout >= period {
+		warnings = append(warnings, fmt.Sprintf("probe_timeout %q is not less than fingerprint_period %q", config.ProbeTimeout, config.FingerprintPeriod))
 	}
 
-	// convert the fingerprint poll period from an HCL string into a time.Duration
-	period, err := time.ParseDuration(config.FingerprintPeriod)
-	if err != nil {
-		return fmt.Errorf("failed to parse doFingerprint period %q: %v", config.FingerprintPeriod, err)
+	for _, warning := range warnings {
+		d.logger.Warn("questionable config", "warning", warning)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
 	}
-	d.fingerprintPeriod = period
 
-	// convert d.config.ignoredInterfaces array to d.ignoredInterfaces map
-	for _, ignoredInterface := range config.IgnoredInterfaces {
-		d.ignoredInterfaces[ignoredInterface] = ignoredInterface
+	d.loadLedger(newReservationLedger(config.LedgerPath, ledgerTTL))
+
+	// save the configuration to the plugin, then apply the overlay config over it,
+	// without a concurrent overlay reload applying it over the previous one
+	d.overlayLock.Lock()
+	defer d.overlayLock.Unlock()
+	d.configLock.Lock()
+	d.fingerprintPeriod = period
+	d.upgradeDrainPeriod = drainPeriod
+	d.removedTimeout = removedTimeout
+	d.probes = newProbeRunner(probeTimeout, probeStalePeriod, probeBackoff, probeBackoffMax)
+	d.baseConfig = config
+	d.configLock.Unlock()
+	d.setConfig(&config)
+	if config.OverlayConfigPath != "" {
+		d.applyOverlayConfig()
 	}
 
 	d.logger.Info("config set", "config", log.Fmt("% #v", pretty.Formatter(config)))
 	return nil
 }
 
+// getConfig returns the current config.  It must not be modified.
+func (d *OnloadDevicePlugin) getConfig() *OnloadDevicePluginConfig {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return d.config
+}
+
+// getProbes returns the probe runner of the current config
+func (d *OnloadDevicePlugin) getProbes() *probeRunner {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return d.probes
+}
+
+// setConfig makes config the current config, rebuilding the ignored interfaces from it
+func (d *OnloadDevicePlugin) setConfig(config *OnloadDevicePluginConfig) {
+	// convert config.IgnoredInterfaces array to d.ignoredInterfaces map
+	ignoredInterfaces := make(map[string]string)
+	for _, ignoredInterface := range config.IgnoredInterfaces {
+		ignoredInterfaces[ignoredInterface] = ignoredInterface
+	}
+
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	d.config = config
+	d.ignoredInterfaces = ignoredInterfaces
+}
+
 // Fingerprint streams detected devices.
 // Messages should be emitted to the returned channel when there are changes
 // to the devices or their health.
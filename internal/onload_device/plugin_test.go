@@ -0,0 +1,155 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"reflect"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+)
+
+// parseTestConfig parses the HCL plugin config src per ConfigSchema, as the Nomad client does
+func parseTestConfig(t *testing.T, src string) OnloadDevicePluginConfig {
+	t.Helper()
+	spec, err := NewOnloadDevicePlugin(log.NewNullLogger()).ConfigSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config OnloadDevicePluginConfig
+	hclutils.NewConfigParser(spec).ParseHCL(t, src, &config)
+	return config
+}
+
+func TestConfigSchemaEnv(t *testing.T) {
+	tests := []struct {
+		name         string
+		src          string
+		wantTypeEnv  map[string]map[string]string
+		wantIfaceEnv map[string]map[string]string
+	}{
+		{
+			name:         "defaults",
+			src:          `config {}`,
+			wantTypeEnv:  map[string]map[string]string{},
+			wantIfaceEnv: map[string]map[string]string{},
+		},
+		{
+			// the example of the README's Default Environment
+			name: "README",
+			src: `
+config {
+  device_type_env = {
+    onload = {
+      EF_POLL_USEC = "100000"
+      EF_SPIN_USEC = "100000"
+    }
+  }
+  interface_env = {
+    eth1 = {
+      EF_POLL_USEC    = "0"
+      EF_CLUSTER_NAME = "{{.Interface}}-numa{{.NUMANode}}"
+    }
+  }
+}`,
+			wantTypeEnv: map[string]map[string]string{
+				"onload": {"EF_POLL_USEC": "100000", "EF_SPIN_USEC": "100000"},
+			},
+			wantIfaceEnv: map[string]map[string]string{
+				"eth1": {"EF_POLL_USEC": "0", "EF_CLUSTER_NAME": "{{.Interface}}-numa{{.NUMANode}}"},
+			},
+		},
+		{
+			name: "blocks",
+			src: `
+config {
+  device_type_env {
+    onload {
+      EF_POLL_USEC = "100000"
+    }
+    onload-latency {
+      EF_SPIN_USEC = "1"
+    }
+  }
+  device_type_env {
+    onload {
+      EF_SPIN_USEC = "100000"
+    }
+  }
+}`,
+			wantTypeEnv: map[string]map[string]string{
+				"onload":         {"EF_POLL_USEC": "100000", "EF_SPIN_USEC": "100000"},
+				"onload-latency": {"EF_SPIN_USEC": "1"},
+			},
+			wantIfaceEnv: map[string]map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := parseTestConfig(t, tt.src)
+			if !reflect.DeepEqual(map[string]map[string]string(config.DeviceTypeEnv), tt.wantTypeEnv) {
+				t.Errorf("device_type_env = %v, want %v", config.DeviceTypeEnv, tt.wantTypeEnv)
+			}
+			if !reflect.DeepEqual(map[string]map[string]string(config.InterfaceEnv), tt.wantIfaceEnv) {
+				t.Errorf("interface_env = %v, want %v", config.InterfaceEnv, tt.wantIfaceEnv)
+			}
+			if _, errs := config.validate(); len(errs) != 0 {
+				t.Errorf("validate: %v", errs)
+			}
+		})
+	}
+}
+
+func TestConfigSchemaAttributes(t *testing.T) {
+	want := map[string]string{"rack": "r12", "exchange": "xnys"}
+	for _, src := range []string{
+		`config { attributes = { rack = "r12", exchange = "xnys" } }`,
+		"config {\n  attributes {\n    rack = \"r12\"\n    exchange = \"xnys\"\n  }\n}",
+		"config {\n  attributes { rack = \"r12\" }\n  attributes { exchange = \"xnys\" }\n}",
+	} {
+		config := parseTestConfig(t, src)
+		if !reflect.DeepEqual(map[string]string(config.Attributes), want) {
+			t.Errorf("attributes of %s = %v, want %v", src, config.Attributes, want)
+		}
+	}
+	if config := parseTestConfig(t, `config {}`); len(config.Attributes) != 0 {
+		t.Errorf("default attributes = %v, want none", config.Attributes)
+	}
+}
+
+func TestConfigSchemaNumNIC(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		wantCount int
+		wantAuto  bool
+		wantErr   bool
+	}{
+		{name: "default", src: `config {}`, wantCount: 10},
+		{name: "number", src: `config { num_nic = 4 }`, wantCount: 4},
+		{name: "auto", src: `config { num_nic = "auto" }`, wantCount: numNIC_AutoFallback, wantAuto: true},
+		{name: "auto flag", src: `config { num_nic = 4 num_nic_auto = true }`, wantCount: 4, wantAuto: true},
+		{name: "invalid", src: `config { num_nic = "many" }`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := parseTestConfig(t, tt.src)
+			config.resolveNumNIC()
+			_, errs := config.validateRuntimeSettings()
+			if tt.wantErr {
+				if len(errs) == 0 {
+					t.Errorf("num_nic %q is valid, want an error", config.NumNICSetting)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("errors: %v", errs)
+			}
+			if config.NumPsuedoNIC != tt.wantCount || config.NumPsuedoNICAuto != tt.wantAuto {
+				t.Errorf("num_nic = %d, auto %v, want %d, auto %v", config.NumPsuedoNIC, config.NumPsuedoNICAuto, tt.wantCount, tt.wantAuto)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"path"
+)
+
+// Mounting into the Task's `/usr` shadows any Onload files of the image, like those of
+// the neomantra/onload images, and may break images with a different layout.  With
+// `task_prefix`, like `/opt/nomad-onload`, all Onload and TCPDirect files are instead
+// mounted under it, and Tasks find them via `PATH`, `LD_PRELOAD` and `ONLOAD_PREFIX`.
+
+// env_OnloadPrefix is the Task path of `task_prefix`
+const env_OnloadPrefix = "ONLOAD_PREFIX"
+
+// Directories of the files mounted under `task_prefix`
+const (
+	prefixDir_Lib      = "lib"      // Onload and TCPDirect libraries, and their ELF dependencies
+	prefixDir_Bin      = "bin"      // Onload and TCPDirect executables, and their dependencies
+	prefixDir_Profiles = "profiles" // Onload profiles
+)
+
+// withTaskPrefix returns a copy of the config with its Task paths under `task_prefix`,
+// if set.  Empty Task paths remain empty, disabling them.  Devices are not moved.
+func (c *OnloadDevicePluginConfig) withTaskPrefix() *OnloadDevicePluginConfig {
+	if c.TaskPrefix == "" {
+		return c
+	}
+	config := *c
+	move := func(taskPath *string, dir string) {
+		if *taskPath != "" {
+			*taskPath = path.Join(c.TaskPrefix, dir)
+		}
+	}
+	move(&config.TaskOnloadLibPath, prefixDir_Lib)
+	move(&config.TaskOnloadBinPath, prefixDir_Bin)
+	move(&config.TaskProfileDirPath, prefixDir_Profiles)
+	move(&config.TaskZfLibPath, prefixDir_Lib)
+	move(&config.TaskZfBinPath, prefixDir_Bin)
+	return &config
+}
+
+// reservePrefixEnv sets `ONLOAD_PREFIX`, `PATH` to find the mounted executables, and
+// `LD_LIBRARY_PATH` to find the mounted libraries, if `task_prefix` is set and
+// Onload/ZF devices are reserved
+func (d *OnloadDevicePlugin) reservePrefixEnv(cfg *OnloadDevicePluginConfig, b *reservationBuilder, devices []*FingerprintDeviceData) {
+	if cfg.TaskPrefix == "" {
+		return
+	}
+	var hasOnload, hasZF bool
+	for _, device := range devices {
+		if isOnloadDeviceType(device.DeviceType) {
+			hasOnload = hasOnload || device.DeviceType != deviceType_ZF
+			hasZF = hasZF || device.DeviceType == deviceType_ZF || device.DeviceType == deviceType_OnloadZF
+		}
+	}
+	if !hasOnload && !hasZF {
+		return
+	}
+	b.setEnv(env_OnloadPrefix, cfg.TaskPrefix)
+
+	// the Task's PATH replaces the image's, so it is composed with `task_prefix_path_env`
+	if cfg.MountOnload && ((hasOnload && cfg.TaskOnloadBinPath != "") || (hasZF && cfg.TaskZfBinPath != "")) {
+		pathEnv := path.Join(cfg.TaskPrefix, prefixDir_Bin)
+		if cfg.TaskPrefixPathEnv != "" {
+			pathEnv += envSeparators["PATH"] + cfg.TaskPrefixPathEnv
+		}
+		b.setEnv("PATH", pathEnv)
+	}
+
+	// TCPDirect applications link with libonload_zf.so, which is not preloaded, and the
+	// mounted executables need the onload_stackdump libraries or the ELF dependencies
+	if (hasOnload && cfg.TaskOnloadLibPath != "") || (hasZF && cfg.TaskZfLibPath != "") {
+		b.setEnv("LD_LIBRARY_PATH", path.Join(cfg.TaskPrefix, prefixDir_Lib))
+	}
+}
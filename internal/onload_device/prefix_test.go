@@ -0,0 +1,75 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"reflect"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+func TestReservePrefixEnv(t *testing.T) {
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	cfg := (&OnloadDevicePluginConfig{
+		MountOnload:       true,
+		TaskOnloadBinPath: "/usr/bin",
+		TaskOnloadLibPath: "/usr/lib/x86_64-linux-gnu",
+		TaskZfBinPath:     "/usr/bin",
+		TaskZfLibPath:     "/usr/lib/x86_64-linux-gnu",
+		TaskPrefix:        "/opt/nomad-onload",
+		TaskPrefixPathEnv: "/usr/bin:/bin",
+	}).withTaskPrefix()
+
+	tests := []struct {
+		name       string
+		deviceType string
+		want       map[string]string
+	}{
+		{
+			name:       "onload",
+			deviceType: deviceType_Onload,
+			want: map[string]string{
+				env_OnloadPrefix:  "/opt/nomad-onload",
+				"PATH":            "/opt/nomad-onload/bin:/usr/bin:/bin",
+				"LD_LIBRARY_PATH": "/opt/nomad-onload/lib",
+			},
+		},
+		{
+			name:       "zf",
+			deviceType: deviceType_ZF,
+			want: map[string]string{
+				env_OnloadPrefix:  "/opt/nomad-onload",
+				"PATH":            "/opt/nomad-onload/bin:/usr/bin:/bin",
+				"LD_LIBRARY_PATH": "/opt/nomad-onload/lib",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReservationBuilder()
+			d.reservePrefixEnv(cfg, b, []*FingerprintDeviceData{{ID: "eth0-0", DeviceType: tt.deviceType, Interface: "eth0"}})
+			if !reflect.DeepEqual(b.envs, tt.want) {
+				t.Errorf("envs = %v, want %v", b.envs, tt.want)
+			}
+		})
+	}
+
+	// without mounted libraries, LD_LIBRARY_PATH is not set
+	noLibCfg := *cfg
+	noLibCfg.TaskOnloadLibPath = ""
+	b := newReservationBuilder()
+	d.reservePrefixEnv(&noLibCfg, b, []*FingerprintDeviceData{{ID: "eth0-0", DeviceType: deviceType_Onload, Interface: "eth0"}})
+	if got, ok := b.envs["LD_LIBRARY_PATH"]; ok {
+		t.Errorf("LD_LIBRARY_PATH = %q without mounted libraries, want unset", got)
+	}
+
+	// the configured LD_LIBRARY_PATH is composed with the prefix's
+	b = newReservationBuilder()
+	b.setEnv("LD_LIBRARY_PATH", "/opt/app/lib")
+	d.reservePrefixEnv(cfg, b, []*FingerprintDeviceData{{ID: "eth0-0", DeviceType: deviceType_OnloadZF, Interface: "eth0"}})
+	if got, want := b.envs["LD_LIBRARY_PATH"], "/opt/app/lib:/opt/nomad-onload/lib"; got != want || len(b.errs) != 0 {
+		t.Errorf("LD_LIBRARY_PATH = %q, errors %v, want %q", got, b.errs, want)
+	}
+}
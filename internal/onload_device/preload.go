@@ -0,0 +1,115 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Onload is preloaded into Tasks with `LD_PRELOAD`.  As Nomad sets the Task's environment
+// over the image's, an image's own `LD_PRELOAD`, like jemalloc or a profiler, is lost;
+// such libraries may be listed in `preload_libraries`, and composed with Onload per
+// `preload_policy`.  Programs which reset their environment lose `LD_PRELOAD`, so with
+// `preload_mode = "ld_so_preload"`, a generated `/etc/ld.so.preload` is mounted instead,
+// which the dynamic linker always reads.
+
+// Values of `preload_policy`, composing Onload's libraries with `preload_libraries`
+const (
+	preloadPolicy_Prepend = "prepend" // Onload, then `preload_libraries`
+	preloadPolicy_Append  = "append"  // `preload_libraries`, then Onload
+	preloadPolicy_Replace = "replace" // only Onload
+)
+
+// Values of `preload_mode`
+const (
+	preloadMode_Env         = "env"           // set LD_PRELOAD
+	preloadMode_LdSoPreload = "ld_so_preload" // mount a generated /etc/ld.so.preload
+)
+
+// taskLdSoPreloadPath is where the generated ld.so.preload is mounted in the Task
+const taskLdSoPreloadPath = "/etc/ld.so.preload"
+
+// composePreloads returns the libraries to preload, composing those of the reserved
+// devices with `preload_libraries` per `preload_policy`.  Returns nothing if no
+// device needs preloading.
+func composePreloads(cfg *OnloadDevicePluginConfig, devicePreloads []string) []string {
+	if len(devicePreloads) == 0 {
+		return nil
+	}
+	var preloads []string
+	switch cfg.PreloadPolicy {
+	case preloadPolicy_Append:
+		preloads = append(preloads, cfg.PreloadLibraries...)
+		preloads = append(preloads, devicePreloads...)
+	case preloadPolicy_Replace:
+		preloads = append(preloads, devicePreloads...)
+	default: // preloadPolicy_Prepend
+		preloads = append(preloads, devicePreloads...)
+		preloads = append(preloads, cfg.PreloadLibraries...)
+	}
+	return preloads
+}
+
+// reservePreload sets the libraries to preload of b, composed per `preload_policy`,
+// in `LD_PRELOAD` or in a generated `/etc/ld.so.preload`, per `preload_mode`
+func (d *OnloadDevicePlugin) reservePreload(cfg *OnloadDevicePluginConfig, b *reservationBuilder) {
+	preloads := composePreloads(cfg, b.preloads)
+	if len(preloads) == 0 {
+		return
+	}
+	if cfg.PreloadMode != preloadMode_LdSoPreload {
+		b.setEnv("LD_PRELOAD", strings.Join(preloads, envSeparators["LD_PRELOAD"]))
+		return
+	}
+	hostPath, err := writePreloadFile(cfg.PreloadFileDir, preloads)
+	if err != nil {
+		b.addError(err)
+		return
+	}
+	b.addMount("generated ld.so.preload", taskLdSoPreloadPath, hostPath, false)
+}
+
+// writePreloadFile writes an ld.so.preload file listing preloads into dir, returning its path.
+// Files are named after their contents, so that reservations with the same preloads share one,
+// and a file is never changed while mounted.
+func writePreloadFile(dir string, preloads []string) (string, error) {
+	contents := []byte(strings.Join(preloads, "\n") + "\n")
+	hash := sha256.Sum256(contents)
+	preloadPath := filepath.Join(dir, "ld.so.preload-"+hex.EncodeToString(hash[:8]))
+	if existing, err := os.ReadFile(preloadPath); err == nil && bytes.Equal(existing, contents) {
+		return preloadPath, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create preload_file_dir '%s': %w", dir, err)
+	}
+	// write it atomically, as another reservation may be mounting it
+	tmpFile, err := os.CreateTemp(dir, ".ld.so.preload.tmp*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create ld.so.preload '%s': %w", preloadPath, err)
+	}
+	defer os.Remove(tmpFile.Name()) // no-op once renamed
+
+	if _, err := tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		return "", fmt.Errorf("failed to write ld.so.preload '%s': %w", preloadPath, err)
+	}
+	if err := tmpFile.Chmod(0o644); err != nil {
+		tmpFile.Close()
+		return "", fmt.Errorf("failed to chmod ld.so.preload '%s': %w", preloadPath, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to close ld.so.preload '%s': %w", preloadPath, err)
+	}
+	if err := os.Rename(tmpFile.Name(), preloadPath); err != nil {
+		return "", fmt.Errorf("failed to replace ld.so.preload '%s': %w", preloadPath, err)
+	}
+	return preloadPath, nil
+}
@@ -0,0 +1,103 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+func TestComposePreloads(t *testing.T) {
+	devicePreloads := []string{"/usr/lib/libonload.so"}
+	libraries := []string{"/usr/lib/libjemalloc.so", "/usr/lib/libprofiler.so"}
+	tests := []struct {
+		policy         string
+		devicePreloads []string
+		want           []string
+	}{
+		{preloadPolicy_Prepend, devicePreloads, []string{"/usr/lib/libonload.so", "/usr/lib/libjemalloc.so", "/usr/lib/libprofiler.so"}},
+		{"", devicePreloads, []string{"/usr/lib/libonload.so", "/usr/lib/libjemalloc.so", "/usr/lib/libprofiler.so"}},
+		{preloadPolicy_Append, devicePreloads, []string{"/usr/lib/libjemalloc.so", "/usr/lib/libprofiler.so", "/usr/lib/libonload.so"}},
+		{preloadPolicy_Replace, devicePreloads, []string{"/usr/lib/libonload.so"}},
+		// preload_libraries are only preloaded along with a device's
+		{preloadPolicy_Prepend, nil, nil},
+		{preloadPolicy_Append, nil, nil},
+	}
+	for _, tt := range tests {
+		cfg := &OnloadDevicePluginConfig{PreloadPolicy: tt.policy, PreloadLibraries: libraries}
+		if got := composePreloads(cfg, tt.devicePreloads); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("composePreloads(%q, %v) = %v, want %v", tt.policy, tt.devicePreloads, got, tt.want)
+		}
+	}
+}
+
+func TestWritePreloadFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "preload")
+	preloads := []string{"/usr/lib/libonload.so", "/usr/lib/libjemalloc.so"}
+
+	// the directory is created, and the file is named after its contents
+	path, err := writePreloadFile(dir, preloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first 8 bytes of the SHA-256 of its contents
+	if want := filepath.Join(dir, "ld.so.preload-c3d59802dc34fcab"); path != want {
+		t.Errorf("path = %q, want %q", path, want)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/usr/lib/libonload.so\n/usr/lib/libjemalloc.so\n"; string(contents) != want {
+		t.Errorf("contents = %q, want %q", contents, want)
+	}
+
+	// the same preloads share the file, and others get their own
+	if again, err := writePreloadFile(dir, preloads); err != nil || again != path {
+		t.Errorf("rewrite = %q, %v, want %q", again, err, path)
+	}
+	other, err := writePreloadFile(dir, []string{"/usr/lib/libonload.so"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == path {
+		t.Errorf("different preloads share %q", path)
+	}
+
+	// leaving no temporary files
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("preload directory has %v, want only the 2 preload files", files)
+	}
+}
+
+func TestReservePreloadMode(t *testing.T) {
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	dir := t.TempDir()
+
+	b := newReservationBuilder()
+	b.addPreload("/usr/lib/libonload.so")
+	d.reservePreload(&OnloadDevicePluginConfig{PreloadMode: preloadMode_Env, PreloadLibraries: []string{"/usr/lib/libjemalloc.so"}}, b)
+	if got, want := b.envs["LD_PRELOAD"], "/usr/lib/libonload.so:/usr/lib/libjemalloc.so"; got != want {
+		t.Errorf("LD_PRELOAD = %q, want %q", got, want)
+	}
+
+	// ld_so_preload mounts the generated file rather than setting LD_PRELOAD
+	b = newReservationBuilder()
+	b.addPreload("/usr/lib/libonload.so")
+	d.reservePreload(&OnloadDevicePluginConfig{PreloadMode: preloadMode_LdSoPreload, PreloadFileDir: dir}, b)
+	if _, ok := b.envs["LD_PRELOAD"]; ok {
+		t.Error("LD_PRELOAD set with ld_so_preload")
+	}
+	if len(b.mounts) != 1 || b.mounts[0].mount.TaskPath != taskLdSoPreloadPath || filepath.Dir(b.mounts[0].mount.HostPath) != dir {
+		t.Errorf("mounts = %v, want the generated file at %s", b.mounts, taskLdSoPreloadPath)
+	}
+}
@@ -0,0 +1,233 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Probe failure classes
+const (
+	// probeFailure_NotInstalled is when the probed software or driver is not present.
+	// This is a normal state, so it is neither retried with backoff nor covered by last good results.
+	probeFailure_NotInstalled = "not installed"
+	// probeFailure_Timeout is when the probe did not complete within `probe_timeout`
+	probeFailure_Timeout = "timed out"
+	// probeFailure_Failed is any other probe failure, like a crashed command or malformed output
+	probeFailure_Failed = "failed"
+)
+
+// probeError is a classified probe failure
+type probeError struct {
+	name       string // name of the probe
+	class      string // one of probeFailure_*
+	persistent bool   // failing for longer than `probe_stale_period`
+	err        error
+}
+
+func (e *probeError) Error() string {
+	return fmt.Sprintf("probe %s %s: %v", e.name, e.class, e.err)
+}
+
+func (e *probeError) Unwrap() error {
+	return e.err
+}
+
+// classifyProbeError returns the probeFailure_* class of a probe's error
+func classifyProbeError(err error) string {
+	switch {
+	case errors.Is(err, ErrNotInstalled), errors.Is(err, fs.ErrNotExist), errors.Is(err, exec.ErrNotFound):
+		return probeFailure_NotInstalled
+	case errors.Is(err, context.DeadlineExceeded):
+		return probeFailure_Timeout
+	default:
+		return probeFailure_Failed
+	}
+}
+
+// isProbeFailure returns whether err is a probe failure other than not being installed
+func isProbeFailure(err error) bool {
+	var perr *probeError
+	return errors.As(err, &perr) && perr.class != probeFailure_NotInstalled
+}
+
+// probeHealthDesc returns why devices are unhealthy due to persistently failing probes,
+// or an empty string if they are not.
+func probeHealthDesc(errs ...error) string {
+	var descs []string
+	for _, err := range errs {
+		var perr *probeError
+		if errors.As(err, &perr) && perr.persistent && perr.class != probeFailure_NotInstalled {
+			descs = append(descs, perr.Error())
+		}
+	}
+	return strings.Join(descs, "; ")
+}
+
+// probeState is the history of a probe
+type probeState struct {
+	value       any       // last successful result
+	at          time.Time // time of last successful result, zero if never
+	lastErr     error     // last failure, nil if the last attempt succeeded
+	failures    int       // number of consecutive failures
+	nextAttempt time.Time // when a failing probe may be retried
+}
+
+// probeRunner runs probes with a timeout, remembering their last successful result
+// so that a failing probe does not immediately drop devices from Nomad.
+// Failing probes are retried with exponential backoff, independent of `fingerprint_period`.
+type probeRunner struct {
+	// timeout is the maximum duration of each probe
+	timeout time.Duration
+	// stalePeriod is how long a last successful result may be used after a failure
+	// before the failure is considered persistent
+	stalePeriod time.Duration
+	// backoff and backoffMax bound the delay before retrying a failing probe
+	backoff    time.Duration
+	backoffMax time.Duration
+
+	states map[string]*probeState
+	lock   sync.Mutex
+}
+
+// newProbeRunner returns a probeRunner with the given timeout, staleness window and retry backoff
+func newProbeRunner(timeout time.Duration, stalePeriod time.Duration, backoff time.Duration, backoffMax time.Duration) *probeRunner {
+	return &probeRunner{
+		timeout:     timeout,
+		stalePeriod: stalePeriod,
+		backoff:     backoff,
+		backoffMax:  backoffMax,
+		states:      make(map[string]*probeState),
+	}
+}
+
+// runProbe runs the named probe with the runner's timeout.
+// Upon success, its result is returned and remembered.
+// Upon failure, a *probeError is returned along with the last successful result, if any.
+// The failure is persistent if it has lasted beyond the staleness window.
+// While a failing probe is backing off, it is not run and its last failure is returned.
+//
+// Probes should honor their context, but a probe that hangs regardless
+// (for example, reading a stuck procfs file) is abandoned at the timeout.
+func runProbe[T any](ctx context.Context, r *probeRunner, name string, probe func(context.Context) (T, error)) (T, error) {
+	r.lock.Lock()
+	state, ok := r.states[name]
+	if !ok {
+		state = &probeState{}
+		r.states[name] = state
+	}
+	backingOff := state.lastErr != nil && time.Now().Before(state.nextAttempt)
+	r.lock.Unlock()
+
+	var value T
+	var err error
+	if !backingOff {
+		value, err = runProbeWithTimeout(ctx, r.timeout, probe)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if !backingOff {
+		if err == nil {
+			state.value, state.at = value, now
+			state.lastErr, state.failures = nil, 0
+			return value, nil
+		}
+
+		class := classifyProbeError(err)
+		state.lastErr = &probeError{name: name, class: class, err: err}
+		if class == probeFailure_NotInstalled {
+			// not installed is a normal state, so drop the last result and check every fingerprint
+			state.value, state.at = nil, time.Time{}
+			state.failures, state.nextAttempt = 0, time.Time{}
+			return value, state.lastErr
+		}
+		state.failures++
+		state.nextAttempt = now.Add(r.retryDelay(state.failures))
+	}
+
+	// return the last failure along with the last good value, noting whether it is persistent
+	perr := *state.lastErr.(*probeError)
+	perr.persistent = state.at.IsZero() || now.Sub(state.at) > r.stalePeriod
+	var zero T
+	if lastValue, ok := state.value.(T); ok {
+		return lastValue, &perr
+	}
+	return zero, &perr
+}
+
+// retryDelay returns the exponential backoff after a number of consecutive failures
+func (r *probeRunner) retryDelay(failures int) time.Duration {
+	delay := r.backoff
+	for i := 1; i < failures && delay < r.backoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, r.backoffMax)
+}
+
+// nextRetry returns the earliest time a failing probe may be retried,
+// or the zero time if no probe is failing
+func (r *probeRunner) nextRetry() time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var next time.Time
+	for _, state := range r.states {
+		if state.failures == 0 {
+			continue
+		}
+		if next.IsZero() || state.nextAttempt.Before(next) {
+			next = state.nextAttempt
+		}
+	}
+	return next
+}
+
+// runProbeWithTimeout runs probe, abandoning it if it does not complete within timeout
+func runProbeWithTimeout[T any](ctx context.Context, timeout time.Duration, probe func(context.Context) (T, error)) (T, error) {
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		value T
+		err   error
+	}
+	resultCh := make(chan result, 1) // buffered so an abandoned probe does not block
+	go func() {
+		value, err := probe(probeCtx)
+		resultCh <- result{value, err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		if res.err != nil && probeCtx.Err() != nil {
+			// a killed command reports its signal, so note the timeout instead
+			return res.value, fmt.Errorf("%w: %v", probeCtx.Err(), res.err)
+		}
+		return res.value, res.err
+	case <-probeCtx.Done():
+		var zero T
+		return zero, fmt.Errorf("abandoned: %w", probeCtx.Err())
+	}
+}
+
+// runConcurrently runs each of fns in its own goroutine, returning once all have completed
+func runConcurrently(fns ...func()) {
+	var wg sync.WaitGroup
+	wg.Add(len(fns))
+	for _, fn := range fns {
+		go func(fn func()) {
+			defer wg.Done()
+			fn()
+		}(fn)
+	}
+	wg.Wait()
+}
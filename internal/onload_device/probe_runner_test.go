@@ -0,0 +1,130 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRunProbeTimeout(t *testing.T) {
+	r := newProbeRunner(10*time.Millisecond, time.Hour, 0, 0)
+
+	// a probe honoring its context
+	_, err := runProbe(context.Background(), r, "honoring", func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	var perr *probeError
+	if !errors.As(err, &perr) || perr.class != probeFailure_Timeout {
+		t.Errorf("honoring probe error = %v, want it to time out", err)
+	}
+
+	// a hung probe is abandoned
+	start := time.Now()
+	_, err = runProbe(context.Background(), r, "hung", func(ctx context.Context) (string, error) {
+		time.Sleep(time.Second)
+		return "late", nil
+	})
+	if !errors.As(err, &perr) || perr.class != probeFailure_Timeout {
+		t.Errorf("hung probe error = %v, want it to time out", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("hung probe took %v, want it abandoned at the timeout", elapsed)
+	}
+}
+
+func TestRunProbeBackoff(t *testing.T) {
+	r := newProbeRunner(time.Second, time.Hour, time.Second, 8*time.Second)
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 5: 8 * time.Second} {
+		if got := r.retryDelay(failures); got != want {
+			t.Errorf("retryDelay(%d) = %v, want %v", failures, got, want)
+		}
+	}
+
+	// a failing probe is not run again while backing off
+	r = newProbeRunner(time.Second, time.Hour, time.Hour, time.Hour)
+	runs := 0
+	failing := func(ctx context.Context) (string, error) {
+		runs++
+		return "", fmt.Errorf("crashed")
+	}
+	if !r.nextRetry().IsZero() {
+		t.Errorf("nextRetry = %v before any failure, want zero", r.nextRetry())
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := runProbe(context.Background(), r, "failing", failing); !isProbeFailure(err) {
+			t.Errorf("attempt %d error = %v, want a probe failure", i, err)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("probe ran %d times, want once while backing off", runs)
+	}
+	if retry := r.nextRetry(); time.Until(retry) < 59*time.Minute {
+		t.Errorf("nextRetry = %v, want in an hour", retry)
+	}
+}
+
+func TestRunProbeLastGood(t *testing.T) {
+	var result string
+	var resultErr error
+	probe := func(ctx context.Context) (string, error) {
+		return result, resultErr
+	}
+	run := func(r *probeRunner) (string, *probeError) {
+		t.Helper()
+		value, err := runProbe(context.Background(), r, "version", probe)
+		if err == nil {
+			return value, nil
+		}
+		var perr *probeError
+		if !errors.As(err, &perr) {
+			t.Fatalf("error = %v, want a *probeError", err)
+		}
+		return value, perr
+	}
+
+	// a failure which never succeeded is persistent
+	r := newProbeRunner(time.Second, time.Hour, 0, 0)
+	resultErr = fmt.Errorf("crashed")
+	if value, perr := run(r); value != "" || perr == nil || !perr.persistent || perr.class != probeFailure_Failed {
+		t.Errorf("never succeeded = %q, %v, want a persistent failure", value, perr)
+	}
+	if desc := probeHealthDesc(&probeError{name: "version", class: probeFailure_Failed, persistent: true, err: resultErr}); desc == "" {
+		t.Error("probeHealthDesc of a persistent failure is empty")
+	}
+
+	// the last good result is used within the staleness window
+	result, resultErr = "8.1.0", nil
+	if value, perr := run(r); value != "8.1.0" || perr != nil {
+		t.Errorf("success = %q, %v, want 8.1.0", value, perr)
+	}
+	result, resultErr = "", fmt.Errorf("crashed")
+	value, perr := run(r)
+	if value != "8.1.0" || perr == nil || perr.persistent {
+		t.Errorf("stale = %q, %v, want 8.1.0 with a transient failure", value, perr)
+	}
+	if desc := probeHealthDesc(perr); desc != "" {
+		t.Errorf("probeHealthDesc of a transient failure = %q, want empty", desc)
+	}
+
+	// beyond the staleness window, the failure is persistent, still with the last good result
+	r.stalePeriod = 0
+	if value, perr := run(r); value != "8.1.0" || perr == nil || !perr.persistent {
+		t.Errorf("persistent = %q, %v, want 8.1.0 with a persistent failure", value, perr)
+	}
+
+	// not installed drops the last good result, and is never unhealthy
+	resultErr = fmt.Errorf("onload executable not found: %w", ErrNotInstalled)
+	value, perr = run(r)
+	if value != "" || perr == nil || perr.class != probeFailure_NotInstalled || isProbeFailure(perr) {
+		t.Errorf("not installed = %q, %v, want no result", value, perr)
+	}
+	if desc := probeHealthDesc(perr); desc != "" {
+		t.Errorf("probeHealthDesc of not installed = %q, want empty", desc)
+	}
+}
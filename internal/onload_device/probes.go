@@ -5,26 +5,34 @@ package onload_device
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+// ErrNotInstalled is returned by probes when the probed software is not installed
+var ErrNotInstalled = errors.New("not installed")
+
 // ProbeOnloadVersion probes the system using `onload --version`.
 // Returns the version string, or an empty string and error.
-// `binPath` is the path to the directory with `onload`
-func ProbeOnloadVersion(binPath string) (string, error) {
+// `binPath` is the path to the directory with `onload`.
+// The command is killed if `ctx` is done before it completes.
+func ProbeOnloadVersion(ctx context.Context, binPath string) (string, error) {
 	// Verify that the onload binary exists
 	onloadBinPath := filepath.Join(binPath, "onload")
 	if _, err := os.Stat(onloadBinPath); err != nil {
-		return "", fmt.Errorf("onload executable not found at '%s'", onloadBinPath)
+		return "", fmt.Errorf("onload executable not found at '%s': %w", onloadBinPath, ErrNotInstalled)
 	}
 
 	// Fetch its version info
-	versionBytes, err := exec.Command(onloadBinPath, "--version").Output()
+	versionBytes, err := exec.CommandContext(ctx, onloadBinPath, "--version").Output()
 	if err != nil {
 		return "", fmt.Errorf("'onload --version' failed %w", err)
 	}
@@ -33,23 +41,24 @@ func ProbeOnloadVersion(binPath string) (string, error) {
 	r := regexp.MustCompile("^[Oo]nload ([0-9.]*)")
 	m := r.FindSubmatch(versionBytes)
 	if len(m) != 2 {
-		return "", fmt.Errorf("onload output malformed %w", err)
+		return "", fmt.Errorf("onload output malformed: %q", versionBytes)
 	}
 	return string(m[1]), nil
 }
 
 // ProbeZFVersion probes the system using `zf_stackdump version`.
 // Returns the version string, or an empty string and error.
-// `binPath` is the path to the directory with `zf_stackdump`
-func ProbeZFVersion(binPath string) (string, error) {
+// `binPath` is the path to the directory with `zf_stackdump`.
+// The command is killed if `ctx` is done before it completes.
+func ProbeZFVersion(ctx context.Context, binPath string) (string, error) {
 	// Verify that the onload binary exists
 	zfBinPath := filepath.Join(binPath, "zf_stackdump")
 	if _, err := os.Stat(zfBinPath); err != nil {
-		return "", fmt.Errorf("zf_stackdump executable not found at '%s'", zfBinPath)
+		return "", fmt.Errorf("zf_stackdump executable not found at '%s': %w", zfBinPath, ErrNotInstalled)
 	}
 
 	// Fetch its version info
-	versionBytes, err := exec.Command(zfBinPath, "version").CombinedOutput()
+	versionBytes, err := exec.CommandContext(ctx, zfBinPath, "version").CombinedOutput()
 	if err != nil {
 		return "", fmt.Errorf("'zf_stackdump version' failed %w", err)
 	}
@@ -58,7 +67,7 @@ func ProbeZFVersion(binPath string) (string, error) {
 	r := regexp.MustCompile("^TCPDirect Library version: ([0-9.]*)")
 	m := r.FindSubmatch(versionBytes)
 	if len(m) != 2 {
-		return "", fmt.Errorf("zf_stackdump output malformed %w", err)
+		return "", fmt.Errorf("zf_stackdump output malformed: %q", versionBytes)
 	}
 	return string(m[1]), nil
 }
@@ -72,15 +81,32 @@ func ProbeZFVersion(binPath string) (string, error) {
 // SPDX-FileCopyrightText: (c) Copyright 2023 Advanced Micro Devices, Inc.
 
 // While the Nomad DeviceGroup has a Model concept, that is hard to extract.
-// We use the Interface name instead.
+// We use the Interface name instead, or a stable key with `device_id_source = "pci"`.
 type DeviceInfo struct {
-	Interface string
-	Vendor    string
-	PCIBusID  string
+	Interface  string
+	Vendor     string
+	PCIBusID   string
+	MACAddress string
 }
 
-// Returns a list of the Solarflare (SFC) interfaces present on the node
-func ProbeOnloadSFCNics() ([]DeviceInfo, error) {
+// StableKey returns the key identifying the device, per the `device_id_source` idSource.
+// For "pci", this is the PCI bus address, or the MAC address for non-PCI devices,
+// which survive interface renames.  Otherwise, or if neither is known, it is the interface name.
+func (d DeviceInfo) StableKey(idSource string) string {
+	if idSource == deviceIDSource_PCI {
+		if d.PCIBusID != "" {
+			return d.PCIBusID
+		}
+		if d.MACAddress != "" {
+			return d.MACAddress
+		}
+	}
+	return d.Interface
+}
+
+// Returns a list of the Solarflare (SFC) interfaces present on the node.
+// The `lshw` command is killed if `ctx` is done before it completes.
+func ProbeOnloadSFCNics(ctx context.Context) ([]DeviceInfo, error) {
 	// Takes the output from lshw and returns the device name for each Solarflare device.
 
 	// "lshw -businfo -class network" sample output:
@@ -101,7 +127,7 @@ func ProbeOnloadSFCNics() ([]DeviceInfo, error) {
 	// First match group is the PCI bus, second match group is the Interface
 	r := regexp.MustCompile("^pci@([a-f0-9:.]+) *([a-z0-9]+) *network *.*SFC")
 
-	cmdOutput, err := exec.Command("lshw", "-businfo", "-class", "network").CombinedOutput()
+	cmdOutput, err := exec.CommandContext(ctx, "lshw", "-businfo", "-class", "network").CombinedOutput()
 	if err != nil {
 		return nil, err
 	}
@@ -115,9 +141,10 @@ func ProbeOnloadSFCNics() ([]DeviceInfo, error) {
 		if len(m) == 3 {
 			iface, busid := m[2], m[1]
 			nics = append(nics, DeviceInfo{
-				Interface: iface,
-				Vendor:    vendor_SFC,
-				PCIBusID:  busid,
+				Interface:  iface,
+				Vendor:     vendor_SFC,
+				PCIBusID:   busid,
+				MACAddress: probeMACAddress(iface),
 			})
 		}
 	}
@@ -128,6 +155,18 @@ func ProbeOnloadSFCNics() ([]DeviceInfo, error) {
 	return nics, nil
 }
 
+// sysClassNetPath is where the kernel exposes network interfaces
+const sysClassNetPath = "/sys/class/net"
+
+// probeMACAddress returns the MAC address of a network interface, or an empty string if unknown
+func probeMACAddress(iface string) string {
+	addrBytes, err := os.ReadFile(filepath.Join(sysClassNetPath, iface, "address"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(addrBytes))
+}
+
 // Returns a list of the Onload-XDP interfaces present on the node
 func ProbeOnloadXDPNics() ([]DeviceInfo, error) {
 	// TODO: probe it... use vendor_XDP
@@ -169,3 +208,138 @@ func ProbePTP() ([]DeviceInfo, error) {
 	}
 	return devs, nil
 }
+
+///////////////////////////////////////////////////////////////////////////////
+
+// sysPCIDevicesPath is where the kernel exposes PCI devices
+const sysPCIDevicesPath = "/sys/bus/pci/devices"
+
+// ProbeNUMANode returns the NUMA node of the PCI device at `pciBusID`,
+// like "0000:01:00.0", per `/sys/bus/pci/devices/<pciBusID>/numa_node`.
+// Returns -1 if the device has no NUMA affinity.
+func ProbeNUMANode(pciBusID string) (int, error) {
+	if pciBusID == "" || strings.ContainsRune(pciBusID, '/') {
+		return -1, fmt.Errorf("invalid PCI bus ID '%s'", pciBusID)
+	}
+	nodeBytes, err := os.ReadFile(filepath.Join(sysPCIDevicesPath, pciBusID, "numa_node"))
+	if err != nil {
+		return -1, err
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(nodeBytes)))
+	if err != nil {
+		return -1, fmt.Errorf("numa_node of '%s' malformed: %w", pciBusID, err)
+	}
+	return node, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// sysModulePath is where the kernel exposes loaded module parameters
+const sysModulePath = "/sys/module"
+
+// ProbeModuleParameters reads kernel module parameters from `/sys/module/<module>/parameters`.
+// Each `allowlist` entry is of the form `<module>/<parameter>`, where each part may be a glob.
+// Returns a map of `<module>/<parameter>` to its trimmed value, named after the matched module
+// and parameter.  Modules that are not loaded and parameters that are not readable are skipped.
+func ProbeModuleParameters(allowlist []string) (map[string]string, error) {
+	return probeModuleParameters(sysModulePath, allowlist)
+}
+
+// probeModuleParameters is ProbeModuleParameters with the sysfs module directory moduleDir
+func probeModuleParameters(moduleDir string, allowlist []string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, entry := range allowlist {
+		module, param, ok := strings.Cut(entry, "/")
+		if !ok || module == "" || param == "" || strings.Contains(param, "/") {
+			return nil, fmt.Errorf("module parameter '%s' is not of the form <module>/<parameter>", entry)
+		}
+		paramPaths, err := filepath.Glob(filepath.Join(moduleDir, module, "parameters", param))
+		if err != nil {
+			return nil, fmt.Errorf("module parameter '%s' is malformed %w", entry, err)
+		}
+		for _, paramPath := range paramPaths {
+			valueBytes, err := os.ReadFile(paramPath)
+			if err != nil {
+				continue // some parameters are write-only
+			}
+			// <moduleDir>/<module>/parameters/<param>
+			matchedModule := filepath.Base(filepath.Dir(filepath.Dir(paramPath)))
+			params[matchedModule+"/"+filepath.Base(paramPath)] = strings.TrimSpace(string(valueBytes))
+		}
+	}
+	return params, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// sfcResourceNicsPath is the sfc_resource procfs file describing NIC resources
+const sfcResourceNicsPath = "/proc/driver/sfc_resource/nics"
+
+// NicResources are the Onload hardware resources available on a NIC.
+// A count of -1 means the resource was not reported.
+type NicResources struct {
+	VIs     int // Virtual Interfaces available for stacks
+	PktBufs int // Packet buffers available for stacks
+}
+
+// ProbeSFCNicResources reads the available hardware resources of each NIC from sfc_resource procfs.
+// Returns a map of interface name to its resources.
+func ProbeSFCNicResources() (map[string]NicResources, error) {
+	f, err := os.Open(sfcResourceNicsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	resources, err := parseSFCNicResources(f)
+	if err == nil && len(resources) == 0 {
+		// the format may differ in other sfc_resource versions, so report it rather than ignore it
+		return nil, fmt.Errorf("no NICs with an ifname found in '%s'", sfcResourceNicsPath)
+	}
+	return resources, err
+}
+
+// parseSFCNicResources parses the contents of sfc_resource's `nics` procfs file.
+//
+// Each NIC is expected on its own line as whitespace-separated `key=value` tokens,
+// for example: `0: ifname=eth0 pci=0000:b1:00.0 vi_avail=2032 pkt_buf_avail=1048576`.
+// This format is not verified against a Host; see testdata/sfc_resource/nics.
+// Only the `ifname`, `vi_avail` and `pkt_buf_avail` keys are used; lines without
+// `ifname` are ignored, and malformed counts are errors.
+func parseSFCNicResources(r io.Reader) (map[string]NicResources, error) {
+	resources := make(map[string]NicResources)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		iface, res := "", NicResources{VIs: -1, PktBufs: -1}
+		for _, field := range strings.Fields(scanner.Text()) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			var count *int
+			switch key {
+			case "ifname":
+				iface = value
+				continue
+			case "vi_avail":
+				count = &res.VIs
+			case "pkt_buf_avail":
+				count = &res.PktBufs
+			default:
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s '%s' in '%s'", key, value, sfcResourceNicsPath)
+			}
+			*count = n
+		}
+		if iface != "" {
+			resources[iface] = res
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
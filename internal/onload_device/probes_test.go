@@ -0,0 +1,187 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+func TestParseSFCNicResources(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]NicResources
+		wantErr bool
+	}{
+		{
+			name:  "empty",
+			input: "",
+			want:  map[string]NicResources{},
+		},
+		{
+			name: "nics",
+			input: "0: ifname=eth0 pci=0000:b1:00.0 vi_avail=2032 pkt_buf_avail=1048576\n" +
+				"1: ifname=eth1 pci=0000:b1:00.1 vi_avail=0 pkt_buf_avail=32768\n",
+			want: map[string]NicResources{
+				"eth0": {VIs: 2032, PktBufs: 1048576},
+				"eth1": {VIs: 0, PktBufs: 32768},
+			},
+		},
+		{
+			name:  "missing counts are unknown",
+			input: "0: ifname=eth0 vi_avail=16\n1: ifname=eth1 pkt_buf_avail=64\n",
+			want: map[string]NicResources{
+				"eth0": {VIs: 16, PktBufs: -1},
+				"eth1": {VIs: -1, PktBufs: 64},
+			},
+		},
+		{
+			name:  "lines without ifname are ignored",
+			input: "nics:\n0: pci=0000:b1:00.0 vi_avail=16 pkt_buf_avail=64\n",
+			want:  map[string]NicResources{},
+		},
+		{
+			name:  "other keys are ignored",
+			input: "0: ifname=eth0 interface=eth9 vis=1 pkt_bufs=2 vi_avail=16 pkt_buf_avail=64\n",
+			want: map[string]NicResources{
+				"eth0": {VIs: 16, PktBufs: 64},
+			},
+		},
+		{
+			name:    "malformed count",
+			input:   "0: ifname=eth0 vi_avail=many pkt_buf_avail=64\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative count",
+			input:   "0: ifname=eth0 vi_avail=16 pkt_buf_avail=-1\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSFCNicResources(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSFCNicResourcesFixture(t *testing.T) {
+	// the fixture is in the format parseSFCNicResources expects, not captured from a Host
+	f, err := os.Open("testdata/sfc_resource/nics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := parseSFCNicResources(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]NicResources{
+		"ens1f0np0": {VIs: 2032, PktBufs: 1048576},
+		"ens1f1np1": {VIs: 2040, PktBufs: 1015808},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNICDeviceCount(t *testing.T) {
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	cfg := &OnloadDevicePluginConfig{
+		NumPsuedoNIC:     10,
+		NumPsuedoNICAuto: true,
+		StackVIs:         1,
+		StackPktBufs:     0,
+		DeviceIDSource:   deviceIDSource_Interface,
+	}
+	dev := DeviceInfo{Interface: "eth0"}
+	count := func(vis int) int {
+		return d.nicDeviceCount(cfg, dev, map[string]NicResources{"eth0": {VIs: vis, PktBufs: -1}})
+	}
+
+	if got := count(8); got != 8 {
+		t.Errorf("initial count = %d, want 8", got)
+	}
+	if got := count(5); got != 8 {
+		t.Errorf("count after stacks started = %d, want 8", got)
+	}
+	if got := count(12); got != 12 {
+		t.Errorf("count after resources grew = %d, want 12", got)
+	}
+	if got := d.nicDeviceCount(cfg, dev, nil); got != 10 {
+		t.Errorf("count with unknown resources = %d, want num_nic 10", got)
+	}
+
+	cfg.StackVIs = 2
+	if got := count(6); got != 3 {
+		t.Errorf("count after budget change = %d, want 3", got)
+	}
+}
+
+func TestProbeModuleParameters(t *testing.T) {
+	moduleDir := t.TempDir()
+	for name, value := range map[string]string{
+		"onload/parameters/max_layer2_interfaces":         "8\n",
+		"sfc/parameters/rss_cpus":                         "cores\n",
+		"sfc_driverlink/parameters/rss_cpus":              "1\n",
+		"sfc_resource/parameters/enable_accel_by_default": "Y\n",
+		"sfc_resource/parameters/pio":                     "1\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(moduleDir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(moduleDir, name), []byte(value), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		allowlist []string
+		want      map[string]string
+		wantErr   bool
+	}{
+		{
+			name:      "parameter",
+			allowlist: []string{"onload/max_layer2_interfaces", "onload/missing", "not_loaded/param"},
+			want:      map[string]string{"onload/max_layer2_interfaces": "8"},
+		},
+		{
+			name:      "parameter glob",
+			allowlist: []string{"sfc_resource/*"},
+			want:      map[string]string{"sfc_resource/enable_accel_by_default": "Y", "sfc_resource/pio": "1"},
+		},
+		{
+			// attributes are named after the matched modules, not the glob
+			name:      "module glob",
+			allowlist: []string{"sfc*/rss_cpus"},
+			want:      map[string]string{"sfc/rss_cpus": "cores", "sfc_driverlink/rss_cpus": "1"},
+		},
+		{name: "malformed", allowlist: []string{"onload"}, wantErr: true},
+		{name: "malformed glob", allowlist: []string{"onload/[max"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := probeModuleParameters(moduleDir, tt.allowlist)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
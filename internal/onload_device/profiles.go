@@ -0,0 +1,164 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Onload profiles, like `latency`, are shell scripts in the profiles directory, sourced
+// by the `onload` wrapper, which set `EF_*` variables with `onload_set`.  Profiles
+// matching `profile_device_types` are published as device types like `onload-latency`,
+// whose reservations are like `onload` ones, plus the profile's settings in the environment,
+// so that Tasks need not use the wrapper.  Settings inside shell conditionals or using
+// shell expansions cannot be evaluated, so they are skipped with a warning.
+
+// deviceTypePrefix_Profile prefixes the device types of Onload profiles, like "onload-latency"
+const deviceTypePrefix_Profile = deviceType_Onload + "-"
+
+// profileFileExt is the file extension of Onload profiles
+const profileFileExt = ".opf"
+
+// maxProfileImportDepth limits nested `onload_import`, in case of loops
+const maxProfileImportDepth = 8
+
+// ProbeOnloadProfiles returns the sorted names of the Onload profiles in `profileDir`, like "latency"
+func ProbeOnloadProfiles(profileDir string) ([]string, error) {
+	entries, err := os.ReadDir(profileDir)
+	if err != nil {
+		return nil, err
+	}
+	var profiles []string
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), profileFileExt); ok && name != "" && !entry.IsDir() {
+			profiles = append(profiles, name)
+		}
+	}
+	sort.Strings(profiles)
+	return profiles, nil
+}
+
+// profileOfDeviceType returns the Onload profile of a profile device type,
+// like "latency" for "onload-latency", and whether it is one
+func profileOfDeviceType(deviceType string) (string, bool) {
+	profile, ok := strings.CutPrefix(deviceType, deviceTypePrefix_Profile)
+	return profile, ok && profile != ""
+}
+
+// profileDeviceTypes returns the device types of the profiles matching the globs of patterns
+func profileDeviceTypes(profiles []string, patterns []string) []string {
+	var deviceTypes []string
+	for _, profile := range profiles {
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, profile); matched {
+				deviceTypes = append(deviceTypes, deviceTypePrefix_Profile+profile)
+				break
+			}
+		}
+	}
+	return deviceTypes
+}
+
+// LoadOnloadProfile returns the environment variables set by the Onload profile named `profile`
+// in `profileDir`, following `onload_import`.  Settings which cannot be evaluated without
+// a shell are skipped, and described by the returned warnings.
+func LoadOnloadProfile(profileDir string, profile string) (env map[string]string, warnings []string, err error) {
+	env = make(map[string]string)
+	warnings, err = loadOnloadProfile(profileDir, profile, env, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return env, warnings, nil
+}
+
+// loadOnloadProfile sets the settings of profile into env, where importing are
+// the profiles importing it
+func loadOnloadProfile(profileDir string, profile string, env map[string]string, importing []string) (warnings []string, err error) {
+	if profile == "" || strings.ContainsRune(profile, '/') {
+		return nil, fmt.Errorf("invalid profile name %q", profile)
+	}
+	if slices.Contains(importing, profile) || len(importing) >= maxProfileImportDepth {
+		return nil, fmt.Errorf("profile %q imports itself via %s", profile, strings.Join(importing, ", "))
+	}
+	profilePath := filepath.Join(profileDir, profile+profileFileExt)
+	f, err := os.Open(profilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	depth := 0 // nesting of shell compound commands, whose settings are conditional
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		words := strings.Fields(strings.ReplaceAll(line, ";", " ; "))
+		if len(words) == 0 {
+			continue
+		}
+		// settings within compound commands, or chained with && or ||, are conditional.
+		// Compound commands may open and close within a line, like `if ...; then ...; fi`.
+		conditional := depth != 0 || strings.Contains(line, "&&") || strings.Contains(line, "||")
+		for _, word := range words {
+			switch word {
+			case "if", "case", "for", "while", "until":
+				depth++
+				conditional = true
+			case "fi", "esac", "done":
+				depth = max(depth-1, 0)
+			}
+		}
+		if !slices.Contains(words, "onload_set") && !slices.Contains(words, "onload_import") {
+			continue
+		}
+
+		where := fmt.Sprintf("%s:%d", profilePath, lineNum)
+		if conditional {
+			warnings = append(warnings, fmt.Sprintf("%s: skipping conditional '%s'", where, strings.TrimSpace(line)))
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] != "onload_set" && fields[0] != "onload_import" {
+			continue
+		}
+		if strings.ContainsAny(line, "$`") {
+			warnings = append(warnings, fmt.Sprintf("%s: skipping shell expansion in '%s'", where, strings.TrimSpace(line)))
+			continue
+		}
+		if fields[0] == "onload_import" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s: malformed onload_import", where)
+			}
+			importWarnings, err := loadOnloadProfile(profileDir, fields[1], env, append(importing, profile))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", where, err)
+			}
+			warnings = append(warnings, importWarnings...)
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s: malformed onload_set", where)
+		}
+		env[fields[1]] = unquoteShellWord(strings.Join(fields[2:], " "))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", profilePath, err)
+	}
+	return warnings, nil
+}
+
+// unquoteShellWord removes the quotes surrounding word, if any
+func unquoteShellWord(word string) string {
+	if len(word) >= 2 && (word[0] == '"' || word[0] == '\'') && word[len(word)-1] == word[0] {
+		return word[1 : len(word)-1]
+	}
+	return word
+}
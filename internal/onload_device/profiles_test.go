@@ -0,0 +1,138 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testProfileDir has profiles modeled on those shipped with Onload, and broken ones
+const testProfileDir = "testdata/profiles"
+
+func TestProbeOnloadProfiles(t *testing.T) {
+	profiles, err := ProbeOnloadProfiles(testProfileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"and-or", "inline-if", "latency", "latency-best", "loop-a", "loop-b", "malformed", "missing-import"}
+	if !reflect.DeepEqual(profiles, want) {
+		t.Errorf("profiles = %v, want %v", profiles, want)
+	}
+
+	deviceTypes := profileDeviceTypes(profiles, []string{"latency*", "throughput"})
+	if want := []string{"onload-latency", "onload-latency-best"}; !reflect.DeepEqual(deviceTypes, want) {
+		t.Errorf("profileDeviceTypes = %v, want %v", deviceTypes, want)
+	}
+}
+
+func TestLoadOnloadProfile(t *testing.T) {
+	tests := []struct {
+		profile      string
+		wantEnv      map[string]string
+		wantWarnings []string // substrings of each warning, in order
+		wantErr      string
+	}{
+		{
+			profile: "latency",
+			wantEnv: map[string]string{
+				"EF_POLL_USEC":          "100000",
+				"EF_TCP_FASTSTART_INIT": "0",
+				"EF_TCP_FASTSTART_IDLE": "0",
+				"EF_TCP_INITIAL_CWND":   "30000",
+			},
+		},
+		{
+			// imports latency, overriding EF_POLL_USEC, with quoting, comments,
+			// nested conditionals and shell expansions
+			profile: "latency-best",
+			wantEnv: map[string]string{
+				"EF_POLL_USEC":           "1000000000",
+				"EF_TCP_FASTSTART_INIT":  "0",
+				"EF_TCP_FASTSTART_IDLE":  "0",
+				"EF_TCP_INITIAL_CWND":    "30000",
+				"EF_SLEEP_SPIN_USEC":     "50",
+				"EF_CTPIO_MODE":          "ct",
+				"EF_CTPIO_SWITCH_BYPASS": "1",
+				"EF_INT_DRIVEN":          "0",
+			},
+			wantWarnings: []string{
+				"latency-best.opf:22: skipping conditional 'onload_set EF_PIO 1'",
+				"latency-best.opf:24: skipping conditional 'x2*) onload_set EF_CTPIO 0 ;;'",
+				"latency-best.opf:26: skipping conditional 'onload_set EF_PIO_THRESHOLD 1514'",
+				"latency-best.opf:30: skipping shell expansion",
+				"latency-best.opf:31: skipping shell expansion",
+			},
+		},
+		{
+			// compound commands opened and closed within a line
+			profile: "inline-if",
+			wantEnv: map[string]string{"EF_POLL_USEC": "100000"},
+			wantWarnings: []string{
+				"inline-if.opf:3: skipping conditional 'if [ -e /dev/onload ]; then onload_set EF_PIO 1; fi'",
+				"inline-if.opf:4: skipping conditional",
+			},
+		},
+		{
+			profile: "and-or",
+			wantEnv: map[string]string{"EF_POLL_USEC": "100000"},
+			wantWarnings: []string{
+				"and-or.opf:3: skipping conditional '[ -e /dev/onload ] && onload_set EF_PIO 1'",
+				"and-or.opf:4: skipping conditional 'onload_set EF_CTPIO 0 || true'",
+			},
+		},
+		{profile: "loop-a", wantErr: `profile "loop-a" imports itself via loop-a, loop-b`},
+		{profile: "malformed", wantErr: "malformed.opf:1: malformed onload_set"},
+		{profile: "missing-import", wantErr: "missing-import.opf:1: open testdata/profiles/not-installed.opf"},
+		{profile: "not-installed", wantErr: "not-installed.opf"},
+		{profile: "../profiles/latency", wantErr: "invalid profile name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			env, warnings, err := LoadOnloadProfile(testProfileDir, tt.profile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(env, tt.wantEnv) {
+				t.Errorf("env = %v, want %v", env, tt.wantEnv)
+			}
+			if len(warnings) != len(tt.wantWarnings) {
+				t.Fatalf("warnings = %q, want %d", warnings, len(tt.wantWarnings))
+			}
+			for i, want := range tt.wantWarnings {
+				if !strings.Contains(warnings[i], want) {
+					t.Errorf("warning %d = %q, want it to contain %q", i, warnings[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnquoteShellWord(t *testing.T) {
+	tests := map[string]string{
+		`ct`:       "ct",
+		`"ct"`:     "ct",
+		`'ct'`:     "ct",
+		`"a b"`:    "a b",
+		`"ct'`:     `"ct'`,
+		`"`:        `"`,
+		`""`:       "",
+		`'"ct"'`:   `"ct"`,
+		`ct"`:      `ct"`,
+		`100000`:   "100000",
+		`'100000'`: "100000",
+	}
+	for word, want := range tests {
+		if got := unquoteShellWord(word); got != want {
+			t.Errorf("unquoteShellWord(%s) = %s, want %s", word, got, want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/device"
+)
+
+// Reservations are built with a reservationBuilder, which checks every Host path
+// before the reservation is returned.  Otherwise a missing file only shows up later,
+// as an opaque error from the task driver.
+//
+// The builder merges the contributions of all the reserved devices, as a Task may
+// reserve several devices of one type, or several types, needing the same files.
+// Identical mounts and devices are kept once, while different Host paths for the
+// same Task path are conflicts, failing the reservation.  Likewise, list environment
+// variables, like LD_PRELOAD, are composed, while other differing values are conflicts.
+
+// envSeparators are the separators of the environment variables which are lists,
+// so that values from several devices are composed rather than conflicting
+var envSeparators = map[string]string{
+	"LD_PRELOAD":           ":",
+	"LD_LIBRARY_PATH":      ":",
+	"PATH":                 ":",
+	env_InterfaceWhitelist: " ",
+}
+
+// reservationMount is a mount of a reservation
+type reservationMount struct {
+	mount    *device.Mount
+	desc     string // like "Onload library", for errors
+	optional bool   // whether it is skipped if missing, rather than failing the reservation
+}
+
+// reservationDevice is a device of a reservation
+type reservationDevice struct {
+	spec *device.DeviceSpec
+	desc string // like "Onload device", for errors
+}
+
+// reservationBuilder builds a device.ContainerReservation
+type reservationBuilder struct {
+	mounts   []*reservationMount
+	devices  []*reservationDevice
+	envs     map[string]string
+	preloads []string // Task paths of the libraries to preload, composed by reservePreload
+	errs     []error  // problems found while building, like conflicts
+}
+
+// newReservationBuilder returns an empty reservationBuilder
+func newReservationBuilder() *reservationBuilder {
+	return &reservationBuilder{
+		envs: make(map[string]string),
+	}
+}
+
+// addMount adds a read-only mount of hostPath at taskPath.  If it is already mounted,
+// it is required if either is, and mounting a different Host path there is a conflict.
+func (b *reservationBuilder) addMount(desc string, taskPath string, hostPath string, optional bool) {
+	for _, m := range b.mounts {
+		if m.mount.TaskPath != taskPath {
+			continue
+		}
+		if m.mount.HostPath != hostPath {
+			b.errs = append(b.errs, fmt.Errorf("task path '%s' is mounted from both '%s' and '%s'", taskPath, m.mount.HostPath, hostPath))
+			return
+		}
+		m.optional = m.optional && optional
+		return
+	}
+	b.mounts = append(b.mounts, &reservationMount{
+		mount: &device.Mount{
+			TaskPath: taskPath,
+			HostPath: hostPath,
+			ReadOnly: true,
+		},
+		desc:     desc,
+		optional: optional,
+	})
+}
+
+// hasMount returns true if a mount is placed at taskPath
+func (b *reservationBuilder) hasMount(taskPath string) bool {
+	for _, m := range b.mounts {
+		if m.mount.TaskPath == taskPath {
+			return true
+		}
+	}
+	return false
+}
+
+// addDevice adds the device node hostPath at taskPath, with the cgroupPerms like "mrw".
+// If it is already added, their permissions are combined, and adding a different
+// Host path there is a conflict.
+func (b *reservationBuilder) addDevice(desc string, taskPath string, hostPath string, cgroupPerms string) {
+	for _, d := range b.devices {
+		if d.spec.TaskPath != taskPath {
+			continue
+		}
+		if d.spec.HostPath != hostPath {
+			b.errs = append(b.errs, fmt.Errorf("task device '%s' is added from both '%s' and '%s'", taskPath, d.spec.HostPath, hostPath))
+			return
+		}
+		for _, perm := range "mrw" {
+			if strings.ContainsRune(cgroupPerms, perm) && !strings.ContainsRune(d.spec.CgroupPerms, perm) {
+				d.spec.CgroupPerms += string(perm)
+			}
+		}
+		return
+	}
+	b.devices = append(b.devices, &reservationDevice{
+		spec: &device.DeviceSpec{
+			TaskPath:    taskPath,
+			HostPath:    hostPath,
+			CgroupPerms: cgroupPerms,
+		},
+		desc: desc,
+	})
+}
+
+// addPreload adds the Task path of a library to preload, unless present
+func (b *reservationBuilder) addPreload(taskPath string) {
+	if !slices.Contains(b.preloads, taskPath) {
+		b.preloads = append(b.preloads, taskPath)
+	}
+}
+
+// addError fails the reservation with err
+func (b *reservationBuilder) addError(err error) {
+	b.errs = append(b.errs, err)
+}
+
+// setEnv sets the environment variable name to value.  If it is already set, a list
+// variable per envSeparators has value appended, unless present, and other variables
+// set to a different value are a conflict.
+func (b *reservationBuilder) setEnv(name string, value string) {
+	prev, ok := b.envs[name]
+	if !ok || prev == value {
+		b.envs[name] = value
+		return
+	}
+	sep, isList := envSeparators[name]
+	if !isList {
+		b.errs = append(b.errs, fmt.Errorf("environment variable %s is set to both %q and %q", name, prev, value))
+		return
+	}
+	if !slices.Contains(strings.Split(prev, sep), value) {
+		b.envs[name] = prev + sep + value
+	}
+}
+
+// build checks every Host path and returns the reservation.  Missing optional mounts
+// are skipped with a warning; conflicts and any other problem fail it, with an error
+// naming each one.
+func (b *reservationBuilder) build(logger log.Logger) (*device.ContainerReservation, error) {
+	resp := &device.ContainerReservation{
+		Envs:    b.envs,
+		Mounts:  []*device.Mount{},
+		Devices: []*device.DeviceSpec{},
+	}
+
+	errs := append([]error{}, b.errs...)
+	for _, m := range b.mounts {
+		if _, err := os.Stat(m.mount.HostPath); err != nil {
+			if m.optional {
+				logger.Warn("optional file not found on the Host, skipping it", "desc", m.desc, "path", m.mount.HostPath, "error", err)
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%s '%s': %w", m.desc, m.mount.HostPath, describeStatError(err)))
+			continue
+		}
+		resp.Mounts = append(resp.Mounts, m.mount)
+	}
+	for _, d := range b.devices {
+		if err := checkDeviceNode(d.spec.HostPath, d.spec.CgroupPerms); err != nil {
+			errs = append(errs, fmt.Errorf("%s '%s': %w", d.desc, d.spec.HostPath, err))
+			continue
+		}
+		resp.Devices = append(resp.Devices, d.spec)
+	}
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+	return resp, nil
+}
+
+// checkDeviceNode returns an error if the file at path is not a character device,
+// or its owner lacks the read and write permissions of cgroupPerms
+func checkDeviceNode(path string, cgroupPerms string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return describeStatError(err)
+	}
+	if info.Mode()&fs.ModeCharDevice == 0 {
+		return fmt.Errorf("is not a character device (mode %s)", info.Mode())
+	}
+	perm := info.Mode().Perm()
+	if strings.Contains(cgroupPerms, "r") && perm&0o400 == 0 {
+		return fmt.Errorf("is not readable (mode %s)", info.Mode())
+	}
+	if strings.Contains(cgroupPerms, "w") && perm&0o200 == 0 {
+		return fmt.Errorf("is not writable (mode %s)", info.Mode())
+	}
+	return nil
+}
+
+// describeStatError returns a concise description of an os.Stat error
+func describeStatError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return errors.New("not found")
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return errors.New("permission denied")
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/device"
+)
+
+func TestReservationBuilderMounts(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "libonload.so", "onload")
+	libPath, binPath := filepath.Join(dir, "libonload.so"), filepath.Join(dir, "onload")
+
+	// identical mounts are kept once, required if either is
+	b := newReservationBuilder()
+	b.addMount("Onload library", "/usr/lib/libonload.so", libPath, true)
+	b.addMount("Onload library", "/usr/lib/libonload.so", libPath, false)
+	b.addMount("onload", "/usr/bin/onload", binPath, false)
+	b.addMount("optional file", "/usr/bin/missing", filepath.Join(dir, "missing"), true)
+	if len(b.mounts) != 3 || b.mounts[0].optional {
+		t.Errorf("mounts = %d, first optional %v, want 3 with the first required", len(b.mounts), b.mounts[0].optional)
+	}
+	resp, err := b.build(log.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*device.Mount{
+		{TaskPath: "/usr/lib/libonload.so", HostPath: libPath, ReadOnly: true},
+		{TaskPath: "/usr/bin/onload", HostPath: binPath, ReadOnly: true},
+	}
+	if !reflect.DeepEqual(resp.Mounts, want) {
+		t.Errorf("mounts = %v, want %v, skipping the missing optional file", resp.Mounts, want)
+	}
+
+	// a different Host path at the same Task path is a conflict, as is a missing required file
+	b = newReservationBuilder()
+	b.addMount("Onload library", "/usr/lib/libonload.so", libPath, false)
+	b.addMount("Onload library", "/usr/lib/libonload.so", binPath, false)
+	b.addMount("zf_stackdump", "/usr/bin/zf_stackdump", filepath.Join(dir, "zf_stackdump"), false)
+	_, err = b.build(log.NewNullLogger())
+	if err == nil {
+		t.Fatal("build succeeded with conflicting mounts")
+	}
+	for _, want := range []string{
+		"task path '/usr/lib/libonload.so' is mounted from both '" + libPath + "' and '" + binPath + "'",
+		"zf_stackdump '" + filepath.Join(dir, "zf_stackdump") + "': not found",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestReservationBuilderDevices(t *testing.T) {
+	// identical devices are kept once, combining their permissions
+	b := newReservationBuilder()
+	b.addDevice("Onload device", "/dev/onload", "/dev/null", "r")
+	b.addDevice("Onload device", "/dev/onload", "/dev/null", "mrw")
+	resp, err := b.build(log.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*device.DeviceSpec{{TaskPath: "/dev/onload", HostPath: "/dev/null", CgroupPerms: "rmw"}}
+	if !reflect.DeepEqual(resp.Devices, want) {
+		t.Errorf("devices = %v, want %v", resp.Devices, want)
+	}
+
+	// a different Host path is a conflict, and device nodes must be character devices
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "onload")
+	b = newReservationBuilder()
+	b.addDevice("Onload device", "/dev/onload", "/dev/null", "rw")
+	b.addDevice("Onload device", "/dev/onload", "/dev/zero", "rw")
+	b.addDevice("Onload epoll device", "/dev/onload_epoll", filepath.Join(dir, "onload"), "rw")
+	_, err = b.build(log.NewNullLogger())
+	if err == nil {
+		t.Fatal("build succeeded with conflicting devices")
+	}
+	for _, want := range []string{
+		"task device '/dev/onload' is added from both '/dev/null' and '/dev/zero'",
+		"is not a character device",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestReservationBuilderEnvs(t *testing.T) {
+	// list variables per envSeparators are composed, without repeating values
+	b := newReservationBuilder()
+	b.setEnv("LD_PRELOAD", "/usr/lib/libonload.so")
+	b.setEnv("LD_PRELOAD", "/usr/lib/libzf.so")
+	b.setEnv("LD_PRELOAD", "/usr/lib/libonload.so")
+	b.setEnv(env_InterfaceWhitelist, "eth0")
+	b.setEnv(env_InterfaceWhitelist, "eth1")
+	b.setEnv(env_InterfaceWhitelist, "eth0")
+	b.setEnv("EF_NAME", "nomad-eth0")
+	b.setEnv("EF_NAME", "nomad-eth0")
+	resp, err := b.build(log.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"LD_PRELOAD":           "/usr/lib/libonload.so:/usr/lib/libzf.so",
+		env_InterfaceWhitelist: "eth0 eth1",
+		"EF_NAME":              "nomad-eth0",
+	}
+	if !reflect.DeepEqual(resp.Envs, want) {
+		t.Errorf("envs = %v, want %v", resp.Envs, want)
+	}
+
+	// other variables set to different values are conflicts
+	b = newReservationBuilder()
+	b.setEnv("EF_NAME", "nomad-eth0")
+	b.setEnv("EF_NAME", "nomad-eth1")
+	_, err = b.build(log.NewNullLogger())
+	if want := `environment variable EF_NAME is set to both "nomad-eth0" and "nomad-eth1"`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %v, want it to contain %q", err, want)
+	}
+}
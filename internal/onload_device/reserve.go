@@ -4,9 +4,13 @@
 package onload_device
 
 import (
+	"context"
 	"fmt"
 	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/nomad/plugins/device"
 )
@@ -26,8 +30,12 @@ var onloadDeviceFiles = []string{
 var onloadLibraryFiles = []string{
 	"libonload.so",
 	"libonload_ext.so",
-	// for onload_stackdump:
-	// TODO: separate config
+}
+
+// onloadStackdumpLibraryFiles are the shared libraries needed by onload_stackdump, unless
+// `elf_dependencies` resolves them.  They are optional, as distributions ship other
+// versions, like libpcap.so.1 on RHEL.
+var onloadStackdumpLibraryFiles = []string{
 	"libpcap.so.0.8",
 	"libdbus-1.so.3",
 }
@@ -63,6 +71,25 @@ var zfBinaryFiles = []string{
 	"zf_debug",
 }
 
+// Environment variables describing the reserved devices to the Task, each a comma-separated
+// list, set only if devices are reserved.  The Onload/ZF ones are parallel, per device ID.
+const (
+	env_OnloadInterfaces = "NOMAD_ONLOAD_INTERFACES" // interfaces of Onload/ZF devices, like "eth0,eth1"
+	env_OnloadPCIAddrs   = "NOMAD_ONLOAD_PCI_ADDRS"  // PCI bus addresses of Onload/ZF devices, empty if unknown
+	env_OnloadDeviceIDs  = "NOMAD_ONLOAD_DEVICE_IDS" // pseudo-device IDs of Onload/ZF devices, like "eth0-0"
+	env_PTPDevices       = "NOMAD_PTP_DEVICES"       // Task paths of PTP devices, like "/dev/ptp1"
+	env_PPSDevices       = "NOMAD_PPS_DEVICES"       // Task paths of PPS devices, like "/dev/pps0"
+)
+
+// env_InterfaceWhitelist limits Onload acceleration to its space-separated interfaces
+const env_InterfaceWhitelist = "EF_INTERFACE_WHITELIST"
+
+// env_StackName names the Onload stacks of a process.  Processes with the same name may share a stack.
+const env_StackName = "EF_NAME"
+
+// maxStackNameLen is the maximum length of an Onload stack name
+const maxStackNameLen = 26
+
 ///////////////////////////////////////////////////////////////////////////////
 
 type reservationError struct {
@@ -88,9 +115,12 @@ func (d *OnloadDevicePlugin) Reserve(deviceIDs []string) (*device.ContainerReser
 	// channel that the device is no longer available.
 	d.deviceLock.RLock()
 	var notExistingIDs []string
+	reservedDevices := make([]*FingerprintDeviceData, 0, len(deviceIDs))
 	for _, id := range deviceIDs {
-		if _, deviceIDExists := d.devices[id]; !deviceIDExists {
+		if device, deviceIDExists := d.devices[id]; !deviceIDExists {
 			notExistingIDs = append(notExistingIDs, id)
+		} else {
+			reservedDevices = append(reservedDevices, device)
 		}
 	}
 	d.deviceLock.RUnlock()
@@ -98,126 +128,338 @@ func (d *OnloadDevicePlugin) Reserve(deviceIDs []string) (*device.ContainerReser
 		return nil, &reservationError{notExistingIDs}
 	}
 
-	// Initialize the response
-	resp := &device.ContainerReservation{
-		Envs:    map[string]string{},
-		Mounts:  []*device.Mount{},
-		Devices: []*device.DeviceSpec{},
-	}
-	// Add devices
-	for _, deviceID := range deviceIDs {
-		device, ok := d.devices[deviceID]
-		if !ok {
-			d.logger.Warn("Reserving a device not known", "deviceID", deviceID)
-			continue
-		}
-
-		switch device.DeviceType {
-		case deviceType_Onload, deviceType_ZF, deviceType_OnloadZF:
-			// updates resp
+	// Build the response
+	b := newReservationBuilder()
+	// Add devices, all per the same config, with its `auto` host paths resolved per the last fingerprint,
+	// and its Task paths under `task_prefix`, if set
+	d.deviceLock.RLock()
+	cfg := d.getConfig().withHostLayout(d.hostLayout).withTaskPrefix()
+	d.deviceLock.RUnlock()
+	for _, device := range reservedDevices {
+		deviceID := device.ID
+		switch {
+		case isOnloadDeviceType(device.DeviceType):
+			// updates b
 			d.logger.Info("Reserving onload device", "deviceID", deviceID, "deviceType", device.DeviceType)
-			d.reserveOnloadDevice(resp, device.DeviceType, deviceID)
-		case deviceType_PTP, deviceType_PPS:
+			d.reserveOnloadDevice(cfg, b, device)
+		case device.DeviceType == deviceType_PTP, device.DeviceType == deviceType_PPS:
 			d.logger.Info("Reserving timekeeping device", "deviceID", deviceID, "deviceType", device.DeviceType)
-			d.reserveTimekeepingDevice(resp, device.DeviceType, device.Model)
+			// the interface is resolved per the latest fingerprint, in case it was renamed
+			d.reserveTimekeepingDevice(cfg, b, device.DeviceType, device.Interface)
 		default:
 			d.logger.Warn("Reserving a DeviceType not known", "deviceType", device.DeviceType, "deviceID", deviceID)
 			continue
 		}
 
 	}
+
+	// describe the reserved devices to the Task
+	d.reserveDeviceEnvs(cfg, b, reservedDevices)
+	d.reserveStackName(cfg, b, reservedDevices)
+	d.reservePrefixEnv(cfg, b, reservedDevices)
+
+	// preload Onload, per `preload_policy` and `preload_mode`
+	d.reservePreload(cfg, b)
+
+	// check every Host path before handing the reservation to the task driver
+	resp, err := b.build(d.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve %s: %w", strings.Join(deviceIDs, ","), err)
+	}
+	d.recordReservation(reservedDevices, resp)
 	return resp, nil
 }
 
+// recordReservation records the successful reservation of devices, producing resp, so that
+// they remain visible if they disappear while in use, their Onload version is drained upon
+// an upgrade, and the reservation is in the ledger.
+// Failing to persist the ledger is logged, but does not fail the reservation.
+func (d *OnloadDevicePlugin) recordReservation(devices []*FingerprintDeviceData, resp *device.ContainerReservation) {
+	now := time.Now()
+	d.deviceLock.Lock()
+	for _, dev := range devices {
+		d.reservedDevices[dev.ID] = now
+	}
+	d.deviceLock.Unlock()
+	if slices.ContainsFunc(devices, func(dev *FingerprintDeviceData) bool { return isOnloadDeviceType(dev.DeviceType) }) {
+		d.recordReservedVersion()
+	}
+
+	d.deviceLock.RLock()
+	entry := &ledgerEntry{
+		OOVersion: d.ooVersion,
+		ZFVersion: d.zfVersion,
+		Mounts:    resp.Mounts,
+		Devices:   resp.Devices,
+		Envs:      resp.Envs,
+	}
+	d.deviceLock.RUnlock()
+	for _, dev := range devices {
+		entry.DeviceIDs = append(entry.DeviceIDs, dev.ID)
+		entry.DeviceTypes = append(entry.DeviceTypes, dev.DeviceType)
+		entry.Interfaces = append(entry.Interfaces, dev.Interface)
+	}
+	if err := d.ledger.record(entry); err != nil {
+		d.logger.Error("failed to record reservation in ledger", "error", err)
+	}
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
-func (d *OnloadDevicePlugin) reserveOnloadDevice(resp *device.ContainerReservation, deviceType string, deviceID string) {
+// recordReservedVersion remembers that the current Onload version was reserved,
+// for draining devices upon an Onload upgrade
+func (d *OnloadDevicePlugin) recordReservedVersion() {
+	d.deviceLock.Lock()
+	defer d.deviceLock.Unlock()
+	if d.ooVersion != "" {
+		d.reservedVersions[d.ooVersion] = time.Now()
+	}
+}
+
+// reserveOnloadDevice adds the files and environment variables of the Onload/ZF device to b
+func (d *OnloadDevicePlugin) reserveOnloadDevice(cfg *OnloadDevicePluginConfig, b *reservationBuilder, device *FingerprintDeviceData) {
+	// Onload profile device types are reserved like "onload", plus the profile's settings
+	deviceType := device.DeviceType
+	profile, isProfile := profileOfDeviceType(deviceType)
+	if isProfile {
+		deviceType = deviceType_Onload
+	}
+
+	// roots are the mounted Host files, whose ELF dependencies are mounted too
+	var roots []string
+
 	// Always mount the Devices
-	if d.config.TaskDevicePath != "" && d.config.HostDevicePath != "" {
+	if cfg.TaskDevicePath != "" && cfg.HostDevicePath != "" {
 		deviceFiles := onloadDeviceFiles
 		if deviceType == deviceType_ZF {
 			deviceFiles = zfDeviceFiles
 		}
 		for _, deviceFile := range deviceFiles {
-			resp.Devices = append(resp.Devices, &device.DeviceSpec{
-				TaskPath:    path.Join(d.config.TaskDevicePath, deviceFile),
-				HostPath:    path.Join(d.config.HostDevicePath, deviceFile),
-				CgroupPerms: "mrw",
-			})
+			b.addDevice("Onload device", path.Join(cfg.TaskDevicePath, deviceFile), path.Join(cfg.HostDevicePath, deviceFile), "mrw")
 		}
 	}
 
-	// Always mount the Libraries
-	if d.config.TaskOnloadLibPath != "" && d.config.HostOnloadLibPath != "" {
+	// Always mount the Libraries, but only the ZF ones for a "zf" deviceType
+	if deviceType != deviceType_ZF && cfg.TaskOnloadLibPath != "" && cfg.HostOnloadLibPath != "" {
 		for _, libName := range onloadLibraryFiles {
-			resp.Mounts = append(resp.Mounts, &device.Mount{
-				TaskPath: path.Join(d.config.TaskOnloadLibPath, libName),
-				HostPath: path.Join(d.config.HostOnloadLibPath, libName),
-				ReadOnly: true,
-			})
+			hostPath := path.Join(cfg.HostOnloadLibPath, libName)
+			roots = append(roots, hostPath)
+			b.addMount("Onload library", path.Join(cfg.TaskOnloadLibPath, libName), hostPath, false)
+		}
+		if !cfg.ELFDependencies {
+			for _, libName := range onloadStackdumpLibraryFiles {
+				hostPath := path.Join(cfg.HostOnloadLibPath, libName)
+				b.addMount("onload_stackdump library", path.Join(cfg.TaskOnloadLibPath, libName), hostPath, true)
+			}
 		}
 	}
 	if (deviceType == deviceType_ZF) || (deviceType == deviceType_OnloadZF) {
-		for _, libName := range zfLibraryFiles {
-			resp.Mounts = append(resp.Mounts, &device.Mount{
-				TaskPath: path.Join(d.config.TaskOnloadLibPath, libName),
-				HostPath: path.Join(d.config.HostOnloadLibPath, libName),
-				ReadOnly: true,
-			})
+		if cfg.TaskZfLibPath != "" && cfg.HostZfLibPath != "" {
+			for _, libName := range zfLibraryFiles {
+				hostPath := path.Join(cfg.HostZfLibPath, libName)
+				roots = append(roots, hostPath)
+				b.addMount("TCPDirect library", path.Join(cfg.TaskZfLibPath, libName), hostPath, false)
+			}
 		}
 	}
 
 	// Copy the Userspace executables and profiles into the container?
-	if d.config.MountOnload {
-		// Onload executables and profiles
-		if d.config.TaskOnloadBinPath != "" && d.config.HostOnloadBinPath != "" {
+	if cfg.MountOnload {
+		// Onload executables and profiles, but not for a "zf" deviceType
+		if deviceType != deviceType_ZF && cfg.TaskOnloadBinPath != "" && cfg.HostOnloadBinPath != "" {
 			for _, binName := range onloadBinaryFiles {
-				resp.Mounts = append(resp.Mounts, &device.Mount{
-					TaskPath: path.Join(d.config.TaskOnloadBinPath, binName),
-					HostPath: path.Join(d.config.HostOnloadBinPath, binName),
-					ReadOnly: true,
-				})
+				hostPath := path.Join(cfg.HostOnloadBinPath, binName)
+				roots = append(roots, hostPath)
+				b.addMount("Onload binary", path.Join(cfg.TaskOnloadBinPath, binName), hostPath, false)
 			}
 			for _, depName := range onloadDependFiles {
-				resp.Mounts = append(resp.Mounts, &device.Mount{
-					TaskPath: depName,
-					HostPath: depName,
-					ReadOnly: true,
-				})
+				roots = append(roots, depName)
+				taskPath := depName
+				if cfg.TaskPrefix != "" {
+					taskPath = path.Join(cfg.TaskOnloadBinPath, path.Base(depName)) // found via PATH
+				}
+				b.addMount("Onload binary dependency", taskPath, depName, true)
 			}
 		}
-		if d.config.TaskProfileDirPath != "" && d.config.HostProfileDirPath != "" {
-			resp.Mounts = append(resp.Mounts, &device.Mount{
-				TaskPath: d.config.TaskProfileDirPath,
-				HostPath: d.config.HostProfileDirPath,
-				ReadOnly: true,
-			})
+		if deviceType != deviceType_ZF && cfg.TaskProfileDirPath != "" && cfg.HostProfileDirPath != "" {
+			b.addMount("Onload profile directory", cfg.TaskProfileDirPath, cfg.HostProfileDirPath, false)
 		}
 
 		// ZF / TCPDirect executables
-		if (deviceType == deviceType_ZF) || (deviceType == deviceType_OnloadZF) {
+		if ((deviceType == deviceType_ZF) || (deviceType == deviceType_OnloadZF)) &&
+			cfg.TaskZfBinPath != "" && cfg.HostZfBinPath != "" {
 			for _, binName := range zfBinaryFiles {
-				resp.Mounts = append(resp.Mounts, &device.Mount{
-					TaskPath: path.Join(d.config.TaskOnloadBinPath, binName),
-					HostPath: path.Join(d.config.HostOnloadBinPath, binName),
-					ReadOnly: true,
-				})
+				hostPath := path.Join(cfg.HostZfBinPath, binName)
+				roots = append(roots, hostPath)
+				b.addMount("TCPDirect binary", path.Join(cfg.TaskZfBinPath, binName), hostPath, false)
+			}
+		}
+	}
+
+	// Mount the shared libraries needed by the mounted files, beside the Onload or ZF libraries
+	taskLibPath := cfg.TaskOnloadLibPath
+	if deviceType == deviceType_ZF {
+		taskLibPath = cfg.TaskZfLibPath
+	}
+	if cfg.ELFDependencies && taskLibPath != "" {
+		for _, depPath := range d.elfDependencies(cfg, roots) {
+			taskPath := path.Join(taskLibPath, filepath.Base(depPath))
+			if !b.hasMount(taskPath) {
+				b.addMount("shared library dependency", taskPath, depPath, true)
 			}
 		}
 	}
 
-	// Setup LD_PRELOAD if desired, but not if we are a "zf" deviceType
-	if d.config.SetPreload && deviceType != deviceType_ZF && d.config.TaskOnloadLibPath != "" {
-		resp.Envs["LD_PRELOAD"] = path.Join(d.config.TaskOnloadLibPath, onloadPreloadFile)
+	// Preload Onload if desired, but not if we are a "zf" deviceType
+	if cfg.SetPreload && deviceType != deviceType_ZF && cfg.TaskOnloadLibPath != "" {
+		b.addPreload(path.Join(cfg.TaskOnloadLibPath, onloadPreloadFile))
 	}
+
+	// restrict acceleration to the reserved interface, which "none" is not
+	if slices.Contains(cfg.RestrictInterfaces, deviceType) && device.Interface != deviceName_None {
+		b.setEnv(env_InterfaceWhitelist, device.Interface)
+	}
+
+	// the configured default environment, like EF_* tuning, layered with the profile's settings
+	var profileEnv map[string]string
+	if isProfile {
+		profileEnv = d.onloadProfileEnv(cfg, b, profile)
+	}
+	d.reserveDefaultEnv(cfg, b, device, profileEnv)
+}
+
+// onloadProfileEnv returns the settings of the Onload profile, adding any error to b
+func (d *OnloadDevicePlugin) onloadProfileEnv(cfg *OnloadDevicePluginConfig, b *reservationBuilder, profile string) map[string]string {
+	if cfg.HostProfileDirPath == "" {
+		b.addError(fmt.Errorf("profile %q: host_profile_dir_path is empty", profile))
+		return nil
+	}
+	env, warnings, err := LoadOnloadProfile(cfg.HostProfileDirPath, profile)
+	if err != nil {
+		b.addError(fmt.Errorf("profile %q: %w", profile, err))
+		return nil
+	}
+	for _, warning := range warnings {
+		d.logger.Warn("Onload profile setting skipped", "profile", profile, "warning", warning)
+	}
+	return env
+}
+
+// reserveDeviceEnvs sets the environment variables describing the reserved devices.
+// Those of the Onload/ZF devices are parallel lists, ordered by device ID, so that their
+// n-th entries describe the same device; `none` has an empty PCI address.
+func (d *OnloadDevicePlugin) reserveDeviceEnvs(cfg *OnloadDevicePluginConfig, b *reservationBuilder, devices []*FingerprintDeviceData) {
+	var onloadDevices []*FingerprintDeviceData
+	var ptpDevices, ppsDevices []string
+	for _, device := range devices {
+		switch {
+		case isOnloadDeviceType(device.DeviceType):
+			onloadDevices = append(onloadDevices, device)
+		case device.DeviceType == deviceType_PTP:
+			ptpDevices = append(ptpDevices, path.Join(cfg.TaskDevicePath, device.Interface))
+		case device.DeviceType == deviceType_PPS:
+			ppsDevices = append(ppsDevices, path.Join(cfg.TaskDevicePath, device.Interface))
+		}
+	}
+
+	if len(onloadDevices) != 0 {
+		slices.SortFunc(onloadDevices, func(a, b *FingerprintDeviceData) int {
+			return strings.Compare(a.ID, b.ID)
+		})
+		onloadDevices = slices.CompactFunc(onloadDevices, func(a, b *FingerprintDeviceData) bool {
+			return a.ID == b.ID
+		})
+		var interfaces, pciAddrs, deviceIDs []string
+		for _, device := range onloadDevices {
+			deviceIDs = append(deviceIDs, device.ID)
+			interfaces = append(interfaces, device.Interface)
+			pciAddrs = append(pciAddrs, device.PCIBusID)
+		}
+		b.setEnv(env_OnloadDeviceIDs, strings.Join(deviceIDs, ","))
+		b.setEnv(env_OnloadInterfaces, strings.Join(interfaces, ","))
+		b.setEnv(env_OnloadPCIAddrs, strings.Join(pciAddrs, ","))
+	}
+
+	for name, values := range map[string][]string{
+		env_PTPDevices: ptpDevices,
+		env_PPSDevices: ppsDevices,
+	} {
+		if len(values) != 0 {
+			slices.Sort(values)
+			b.setEnv(name, strings.Join(slices.Compact(values), ","))
+		}
+	}
+}
+
+// elfDependencies returns the Host paths of the shared libraries needed by roots,
+// per elfResolver.closure.  They are cached per Onload and TCPDirect version.
+func (d *OnloadDevicePlugin) elfDependencies(cfg *OnloadDevicePluginConfig, roots []string) []string {
+	d.deviceLock.RLock()
+	version := d.ooVersion + "/" + d.zfVersion
+	d.deviceLock.RUnlock()
+	key := strings.Join(roots, ":") + "|" + strings.Join(cfg.ELFExcludeLibraries, ":")
+
+	d.elfDepsLock.Lock()
+	defer d.elfDepsLock.Unlock()
+	if version != d.elfDepsVersion {
+		d.elfDeps = make(map[string][]string)
+		d.elfDepsVersion = version
+	}
+	if deps, ok := d.elfDeps[key]; ok {
+		return deps
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.getProbes().timeout)
+	defer cancel()
+	var searchDirs []string
+	for _, dir := range []string{cfg.HostOnloadLibPath, cfg.HostZfLibPath} {
+		if dir != "" {
+			searchDirs = append(searchDirs, dir)
+		}
+	}
+	resolver := &elfResolver{
+		searchDirs:  append(searchDirs, elfDefaultLibDirs...),
+		linkerCache: probeLinkerCache(ctx),
+		exclude:     cfg.ELFExcludeLibraries,
+	}
+	deps, missing := resolver.closure(roots)
+	if len(missing) != 0 {
+		d.logger.Warn("shared libraries needed by Onload not found on the Host, so the Task must provide them", "libraries", missing)
+	}
+	d.elfDeps[key] = deps
+	return deps
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 
-func (d *OnloadDevicePlugin) reserveTimekeepingDevice(resp *device.ContainerReservation, deviceType string, deviceInterface string) {
-	resp.Devices = append(resp.Devices, &device.DeviceSpec{
-		TaskPath:    path.Join(d.config.TaskDevicePath, deviceInterface),
-		HostPath:    path.Join(d.config.HostDevicePath, deviceInterface),
-		CgroupPerms: "mrw",
-	})
+func (d *OnloadDevicePlugin) reserveTimekeepingDevice(cfg *OnloadDevicePluginConfig, b *reservationBuilder, deviceType string, deviceInterface string) {
+	desc := "PTP device"
+	if deviceType == deviceType_PPS {
+		desc = "PPS device"
+	}
+	b.addDevice(desc, path.Join(cfg.TaskDevicePath, deviceInterface), path.Join(cfg.HostDevicePath, deviceInterface), "mrw")
+}
+
+// reserveStackName sets EF_NAME per `set_stack_name`, naming the Task's Onload stacks after
+// its first reserved Onload pseudo-device, so Host tools like `onload_stackdump` show whose they are.
+// Names which are too long keep their end, which is the pseudo-device ID.
+func (d *OnloadDevicePlugin) reserveStackName(cfg *OnloadDevicePluginConfig, b *reservationBuilder, devices []*FingerprintDeviceData) {
+	if !cfg.SetStackName {
+		return
+	}
+	var deviceIDs []string
+	for _, device := range devices {
+		if isOnloadDeviceType(device.DeviceType) && device.DeviceType != deviceType_ZF {
+			deviceIDs = append(deviceIDs, device.ID)
+		}
+	}
+	if len(deviceIDs) == 0 {
+		return
+	}
+	name := cfg.StackNamePrefix + slices.Min(deviceIDs)
+	if len(name) > maxStackNameLen {
+		d.logger.Warn("Onload stack name too long, truncating its start", "name", name, "max", maxStackNameLen)
+		name = name[len(name)-maxStackNameLen:]
+	}
+	b.setEnv(env_StackName, name)
 }
@@ -0,0 +1,196 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+func TestReserveDeviceEnvs(t *testing.T) {
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	cfg := &OnloadDevicePluginConfig{TaskDevicePath: "/dev"}
+	devices := []*FingerprintDeviceData{
+		{ID: "eth1-0", DeviceType: deviceType_Onload, Interface: "eth1", PCIBusID: "0000:01:00.1"},
+		{ID: "none-0", DeviceType: deviceType_Onload, Interface: deviceName_None},
+		{ID: "eth0-4", DeviceType: deviceType_ZF, Interface: "eth0", PCIBusID: "0000:01:00.0"},
+		{ID: "eth0-3", DeviceType: deviceType_Onload, Interface: "eth0", PCIBusID: "0000:01:00.0"},
+		{ID: "ptp1-0", DeviceType: deviceType_PTP, Interface: "ptp1"},
+		{ID: "ptp0-0", DeviceType: deviceType_PTP, Interface: "ptp0"},
+	}
+
+	b := newReservationBuilder()
+	d.reserveDeviceEnvs(cfg, b, devices)
+	want := map[string]string{
+		env_OnloadDeviceIDs:  "eth0-3,eth0-4,eth1-0,none-0",
+		env_OnloadInterfaces: "eth0,eth0,eth1,none",
+		env_OnloadPCIAddrs:   "0000:01:00.0,0000:01:00.0,0000:01:00.1,",
+		env_PTPDevices:       "/dev/ptp0,/dev/ptp1",
+	}
+	if len(b.errs) != 0 {
+		t.Fatalf("errors: %v", b.errs)
+	}
+	if !reflect.DeepEqual(b.envs, want) {
+		t.Errorf("envs = %v, want %v", b.envs, want)
+	}
+}
+
+// writeTestFiles creates empty files named names in dir
+func writeTestFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// reserveTestMounts returns the Task paths mounted by reserving an Onload device with cfg
+func reserveTestMounts(t *testing.T, cfg *OnloadDevicePluginConfig) []string {
+	t.Helper()
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	d.probes = newProbeRunner(5*time.Second, 0, time.Second, time.Second)
+	b := newReservationBuilder()
+	d.reserveOnloadDevice(cfg, b, &FingerprintDeviceData{ID: "eth0-0", DeviceType: deviceType_Onload, Interface: "eth0"})
+	resp, err := b.build(d.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var taskPaths []string
+	for _, mount := range resp.Mounts {
+		taskPaths = append(taskPaths, mount.TaskPath)
+	}
+	return taskPaths
+}
+
+func TestReserveStackdumpLibrariesOptional(t *testing.T) {
+	hostLibDir := t.TempDir()
+	cfg := &OnloadDevicePluginConfig{
+		HostOnloadLibPath: hostLibDir,
+		TaskOnloadLibPath: "/usr/lib",
+	}
+
+	// like RHEL, which ships libpcap.so.1
+	writeTestFiles(t, hostLibDir, "libonload.so", "libonload_ext.so", "libpcap.so.1")
+	want := []string{"/usr/lib/libonload.so", "/usr/lib/libonload_ext.so"}
+	if got := reserveTestMounts(t, cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("mounts = %v, want %v", got, want)
+	}
+
+	writeTestFiles(t, hostLibDir, "libpcap.so.0.8", "libdbus-1.so.3")
+	want = append(want, "/usr/lib/libpcap.so.0.8", "/usr/lib/libdbus-1.so.3")
+	if got := reserveTestMounts(t, cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("mounts = %v, want %v", got, want)
+	}
+}
+
+func TestReserveStackdumpLibrariesELF(t *testing.T) {
+	hostLibDir := t.TempDir()
+	cfg := &OnloadDevicePluginConfig{
+		HostOnloadLibPath: hostLibDir,
+		TaskOnloadLibPath: "/usr/lib",
+		ELFDependencies:   true,
+	}
+
+	// the stackdump libraries are left to ELF resolution, which follows the symlinked libonload.so
+	writeTestFiles(t, hostLibDir, "libonload_ext.so", "libpcap.so.0.8", "libdbus-1.so.3")
+	writeTestELF(t, filepath.Join(hostLibDir, "libonload.so.1"), elf.EM_X86_64, []string{"libonload-test-dep.so.1"}, "")
+	symlinkTest(t, "libonload.so.1", filepath.Join(hostLibDir, "libonload.so"))
+	writeTestELF(t, filepath.Join(hostLibDir, "libonload-test-dep.so.1"), elf.EM_X86_64, nil, "")
+	want := []string{
+		"/usr/lib/libonload.so",
+		"/usr/lib/libonload_ext.so",
+		"/usr/lib/libonload.so.1",
+		"/usr/lib/libonload-test-dep.so.1",
+	}
+	if got := reserveTestMounts(t, cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("mounts = %v, want %v", got, want)
+	}
+}
+
+func TestReserveRecordsOnlySuccess(t *testing.T) {
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	d.ledger = newReservationLedger("", time.Hour)
+	d.ooVersion = "8.1.0"
+	d.devices = map[string]*FingerprintDeviceData{
+		"eth0-0": {ID: "eth0-0", DeviceType: deviceType_Onload, Interface: "eth0"},
+	}
+	hostLibDir := t.TempDir()
+	d.setConfig(&OnloadDevicePluginConfig{
+		HostOnloadLibPath: hostLibDir,
+		TaskOnloadLibPath: "/usr/lib",
+	})
+
+	// the Onload libraries are missing, so the reservation fails, recording nothing
+	if _, err := d.Reserve([]string{"eth0-0"}); err == nil {
+		t.Fatal("reserved without the Onload libraries")
+	}
+	if len(d.reservedDevices) != 0 || len(d.reservedVersions) != 0 || len(d.ledger.Entries()) != 0 {
+		t.Errorf("failed reservation recorded: devices %v, versions %v, ledger %v",
+			d.reservedDevices, d.reservedVersions, d.ledger.Entries())
+	}
+
+	writeTestFiles(t, hostLibDir, onloadLibraryFiles...)
+	if _, err := d.Reserve([]string{"eth0-0"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.reservedDevices["eth0-0"]; !ok {
+		t.Errorf("reservedDevices = %v, want eth0-0", d.reservedDevices)
+	}
+	if _, ok := d.reservedVersions["8.1.0"]; !ok {
+		t.Errorf("reservedVersions = %v, want 8.1.0", d.reservedVersions)
+	}
+	if entries := d.ledger.Entries(); len(entries) != 1 || !reflect.DeepEqual(entries[0].DeviceIDs, []string{"eth0-0"}) {
+		t.Errorf("ledger = %v, want the reservation of eth0-0", entries)
+	}
+}
+
+func TestReserveStackName(t *testing.T) {
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	stackName := func(prefix string, devices ...*FingerprintDeviceData) (string, bool) {
+		b := newReservationBuilder()
+		d.reserveStackName(&OnloadDevicePluginConfig{SetStackName: true, StackNamePrefix: prefix}, b, devices)
+		if len(b.errs) != 0 {
+			t.Fatal(b.errs)
+		}
+		name, ok := b.envs[env_StackName]
+		return name, ok
+	}
+	onload := func(id string) *FingerprintDeviceData {
+		return &FingerprintDeviceData{ID: id, DeviceType: deviceType_Onload}
+	}
+
+	// the lowest Onload device ID names the stack, whatever the order of the devices
+	name, _ := stackName("nomad-", onload("eth1-3"), &FingerprintDeviceData{ID: "eth0-0", DeviceType: deviceType_ZF}, onload("eth1-0"))
+	if name != "nomad-eth1-0" {
+		t.Errorf("stack name = %q, want nomad-eth1-0", name)
+	}
+	if _, ok := stackName("nomad-", &FingerprintDeviceData{ID: "ptp0-0", DeviceType: deviceType_PTP}); ok {
+		t.Error("stack name set without Onload devices")
+	}
+
+	// a long name is truncated from its start, keeping the device ID, so names stay distinct
+	prefix := "very-long-cluster-name-prefix-"
+	names := make(map[string]bool)
+	for _, id := range []string{"ens1f0np0-0", "ens1f0np0-1", "ens1f1np1-0"} {
+		name, _ := stackName(prefix, onload(id))
+		if len(name) != maxStackNameLen || !strings.HasSuffix(name, id) {
+			t.Errorf("stack name = %q (%d), want %d characters ending in %s", name, len(name), maxStackNameLen, id)
+		}
+		names[name] = true
+	}
+	if len(names) != 3 {
+		t.Errorf("stack names = %v, want 3 distinct names", names)
+	}
+}
@@ -0,0 +1,311 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The plugin config is validated as a whole, so that all of its problems are reported
+// at once, each naming its setting.  Nomad then refuses to start with a bad config.
+// Suspicious but legal combinations are returned as warnings, which are logged.
+
+// configPathPair is a pair of Task and Host path settings
+type configPathPair struct {
+	name      string // like "onload_lib", for the "task_onload_lib_path" and "host_onload_lib_path" settings
+	taskPath  string
+	hostPath  string
+	allowAuto bool // whether the Host path may be `auto`
+}
+
+// pathPairs returns the config's Task and Host path settings
+func (c *OnloadDevicePluginConfig) pathPairs() []configPathPair {
+	return []configPathPair{
+		{"device", c.TaskDevicePath, c.HostDevicePath, false},
+		{"onload_lib", c.TaskOnloadLibPath, c.HostOnloadLibPath, true},
+		{"onload_bin", c.TaskOnloadBinPath, c.HostOnloadBinPath, true},
+		{"profile_dir", c.TaskProfileDirPath, c.HostProfileDirPath, true},
+		{"zf_bin", c.TaskZfBinPath, c.HostZfBinPath, true},
+		{"zf_lib", c.TaskZfLibPath, c.HostZfLibPath, true},
+	}
+}
+
+// validate validates the whole config, returning warnings and errors.
+// The durations are validated separately, as they are parsed, by parseConfigDuration.
+func (c *OnloadDevicePluginConfig) validate() (warnings []string, errs []error) {
+	warnings, errs = c.validateRuntimeSettings()
+
+	switch c.DeviceIDSource {
+	case deviceIDSource_Interface, deviceIDSource_PCI:
+	default:
+		errs = append(errs, fmt.Errorf("device_id_source: unknown %q, must be %q or %q", c.DeviceIDSource, deviceIDSource_Interface, deviceIDSource_PCI))
+	}
+
+	// Task and Host paths must be absolute, and Host paths must exist, unless discovered with `auto`.
+	// Missing default Host paths are only warnings, as Onload may be installed later, or elsewhere.
+	// A Task path needs its Host path; a Host path without its Task path is not mounted.
+	for _, pair := range c.pathPairs() {
+		taskName, hostName := "task_"+pair.name+"_path", "host_"+pair.name+"_path"
+		if pair.taskPath != "" && !filepath.IsAbs(pair.taskPath) {
+			errs = append(errs, fmt.Errorf("%s: must be an absolute path, got '%s'", taskName, pair.taskPath))
+		}
+		isAuto := pair.allowAuto && pair.hostPath == hostPath_Auto // resolved upon fingerprinting
+		if pair.hostPath != "" && !isAuto && !filepath.IsAbs(pair.hostPath) {
+			errs = append(errs, fmt.Errorf("%s: must be an absolute path, got '%s'", hostName, pair.hostPath))
+		} else if pair.hostPath != "" && !isAuto {
+			if info, err := os.Stat(pair.hostPath); err != nil && isConfigDefault(hostName, pair.hostPath) {
+				warnings = append(warnings, fmt.Sprintf("%s: default '%s' not found, set it to \"auto\" or \"\": %v", hostName, pair.hostPath, err))
+			} else if err != nil {
+				errs = append(errs, fmt.Errorf("%s: '%s' not found, set it to \"\" to disable it: %w", hostName, pair.hostPath, err))
+			} else if !info.IsDir() {
+				errs = append(errs, fmt.Errorf("%s: '%s' is not a directory", hostName, pair.hostPath))
+			}
+		}
+		if pair.taskPath != "" && pair.hostPath == "" {
+			errs = append(errs, fmt.Errorf("%s: is set, but %s is empty", taskName, hostName))
+		} else if pair.taskPath == "" && pair.hostPath != "" {
+			warnings = append(warnings, fmt.Sprintf("%s is set, but %s is empty, so it is not mounted", hostName, taskName))
+		}
+	}
+
+	for _, setting := range []struct{ name, path string }{
+		{"drain_dir", c.DrainDir},
+		{"ledger_path", c.LedgerPath},
+		{"overlay_config_path", c.OverlayConfigPath},
+		{"preload_file_dir", c.PreloadFileDir},
+		{"task_prefix", c.TaskPrefix},
+	} {
+		if setting.path != "" && !filepath.IsAbs(setting.path) {
+			errs = append(errs, fmt.Errorf("%s: must be an absolute path, got '%s'", setting.name, setting.path))
+		}
+	}
+
+	for _, deviceType := range c.RestrictInterfaces {
+		switch deviceType {
+		case deviceType_Onload, deviceType_OnloadZF:
+		case deviceType_ZF:
+			warnings = append(warnings, "restrict_interfaces includes \"zf\", but TCPDirect ignores EF_INTERFACE_WHITELIST")
+		default:
+			errs = append(errs, fmt.Errorf("restrict_interfaces: unknown device type %q", deviceType))
+		}
+	}
+
+	envDeviceTypes := make([]string, 0, len(c.DeviceTypeEnv))
+	for deviceType := range c.DeviceTypeEnv {
+		envDeviceTypes = append(envDeviceTypes, deviceType)
+	}
+	sort.Strings(envDeviceTypes)
+	for _, deviceType := range envDeviceTypes {
+		if !isOnloadDeviceType(deviceType) {
+			errs = append(errs, fmt.Errorf("device_type_env: unknown device type %q", deviceType))
+		}
+	}
+	errs = append(errs, validateEnvTemplates("device_type_env", c.DeviceTypeEnv)...)
+	errs = append(errs, validateEnvTemplates("interface_env", c.InterfaceEnv)...)
+
+	for _, pattern := range c.ProfileDeviceTypes {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("profile_device_types: '%s' is malformed: %w", pattern, err))
+		}
+	}
+	if len(c.ProfileDeviceTypes) != 0 && c.HostProfileDirPath == "" {
+		warnings = append(warnings, "profile_device_types is set, but host_profile_dir_path is empty, so no profile device types are published")
+	}
+
+	for _, pattern := range c.ELFExcludeLibraries {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("elf_exclude_libraries: '%s' is malformed: %w", pattern, err))
+		}
+	}
+
+	if c.SetStackName {
+		if len(c.StackNamePrefix) >= maxStackNameLen {
+			errs = append(errs, fmt.Errorf("stack_name_prefix: must be shorter than %d characters, got '%s'", maxStackNameLen, c.StackNamePrefix))
+		}
+		for _, setting := range []struct {
+			name      string
+			envsByKey map[string]map[string]string
+		}{
+			{"device_type_env", c.DeviceTypeEnv},
+			{"interface_env", c.InterfaceEnv},
+		} {
+			var keys []string
+			for key, envs := range setting.envsByKey {
+				if _, ok := envs[env_StackName]; ok {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				errs = append(errs, fmt.Errorf("set_stack_name: is set, but %s sets %s for %q", setting.name, env_StackName, key))
+			}
+		}
+	} else if c.StackNamePrefix != "" {
+		warnings = append(warnings, "stack_name_prefix is set, but set_stack_name is not, so EF_NAME is not set")
+	}
+
+	if c.TaskPrefix != "" && (filepath.Clean(c.TaskPrefix) == "/" || strings.Contains(c.TaskPrefix, ":")) {
+		errs = append(errs, fmt.Errorf("task_prefix: must not be '/', nor contain colons, got '%s'", c.TaskPrefix))
+	}
+
+	if c.SetPreload && c.TaskOnloadLibPath == "" {
+		warnings = append(warnings, "set_preload is set, but task_onload_lib_path is empty, so LD_PRELOAD is not set")
+	}
+	switch c.PreloadPolicy {
+	case preloadPolicy_Prepend, preloadPolicy_Append:
+	case preloadPolicy_Replace:
+		if len(c.PreloadLibraries) != 0 {
+			warnings = append(warnings, "preload_libraries is set, but preload_policy is \"replace\", so they are not preloaded")
+		}
+	default:
+		errs = append(errs, fmt.Errorf("preload_policy: unknown %q, must be %q, %q or %q", c.PreloadPolicy, preloadPolicy_Prepend, preloadPolicy_Append, preloadPolicy_Replace))
+	}
+	switch c.PreloadMode {
+	case preloadMode_Env:
+	case preloadMode_LdSoPreload:
+		if c.PreloadFileDir == "" {
+			errs = append(errs, fmt.Errorf("preload_file_dir: must be set with preload_mode %q", preloadMode_LdSoPreload))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("preload_mode: unknown %q, must be %q or %q", c.PreloadMode, preloadMode_Env, preloadMode_LdSoPreload))
+	}
+	for _, lib := range c.PreloadLibraries {
+		if lib == "" || strings.ContainsAny(lib, ": \t\n") {
+			errs = append(errs, fmt.Errorf("preload_libraries: %q must not be empty, nor contain colons or whitespace", lib))
+		}
+	}
+	if !c.SetPreload && len(c.PreloadLibraries) != 0 {
+		warnings = append(warnings, "preload_libraries is set, but set_preload is not, so nothing is preloaded")
+	}
+	return warnings, errs
+}
+
+// validateRuntimeSettings validates the settings which the overlay config may change,
+// returning warnings and errors
+func (c *OnloadDevicePluginConfig) validateRuntimeSettings() (warnings []string, errs []error) {
+	for _, setting := range []struct {
+		name string
+		num  int
+	}{
+		{"num_nic", c.NumPsuedoNIC},
+		{"num_pps", c.NumPsuedoPPS},
+		{"num_ptp", c.NumPsuedoPTP},
+		{"stack_vis", c.StackVIs},
+		{"stack_pkt_bufs", c.StackPktBufs},
+	} {
+		if setting.num < 0 {
+			errs = append(errs, fmt.Errorf("%s: must not be negative, got %d", setting.name, setting.num))
+		}
+	}
+	if c.NumNICSetting != "" {
+		if _, _, err := parseNumNIC(c.NumNICSetting); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.ProbeSFC && c.NumPsuedoNIC == 0 && !c.NumPsuedoNICAuto {
+		warnings = append(warnings, "num_nic is 0, so no NIC devices are published")
+	}
+	if c.NumPsuedoNICAuto && c.StackVIs == 0 && c.StackPktBufs == 0 {
+		warnings = append(warnings, "num_nic is auto, but stack_vis and stack_pkt_bufs are 0, so its fallback count is always used")
+	}
+
+	// only Onload/ZF device types may be published with device_types, and profile ones with profile_device_types
+	for _, deviceType := range c.DeviceTypes {
+		if _, isProfile := profileOfDeviceType(deviceType); isProfile {
+			errs = append(errs, fmt.Errorf("device_types: %q is an Onload profile device type, publish it with profile_device_types", deviceType))
+		} else if !isOnloadDeviceType(deviceType) {
+			errs = append(errs, fmt.Errorf("device_types: unknown device type %q", deviceType))
+		}
+	}
+	if len(c.DeviceTypes) == 0 {
+		warnings = append(warnings, "device_types is empty, so no Onload or TCPDirect devices are published")
+	}
+
+	for _, entry := range c.ModuleParameters {
+		module, param, ok := strings.Cut(entry, "/")
+		if !ok || module == "" || param == "" || strings.Contains(param, "/") {
+			errs = append(errs, fmt.Errorf("module_parameters: '%s' is not of the form <module>/<parameter>", entry))
+		} else if _, err := filepath.Match(entry, ""); err != nil {
+			errs = append(errs, fmt.Errorf("module_parameters: '%s' is malformed: %w", entry, err))
+		}
+	}
+
+	names := make([]string, 0, len(c.Attributes))
+	for name := range c.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch {
+		case name == "":
+			errs = append(errs, errors.New("attributes: names must not be empty"))
+		case isBuiltinAttribute(name):
+			warnings = append(warnings, fmt.Sprintf("attributes: %q is a built-in attribute, so it is ignored", name))
+		}
+	}
+	return warnings, errs
+}
+
+// isConfigDefault returns true if value is the default of the string setting name
+func isConfigDefault(name string, value string) bool {
+	for _, desc := range configDescriptions {
+		if desc.Name == name {
+			defaultValue, err := strconv.Unquote(desc.Default)
+			return err == nil && defaultValue == value
+		}
+	}
+	return false
+}
+
+// numNIC_Auto is the `num_nic` setting to derive the count from each NIC's resources
+const numNIC_Auto = "auto"
+
+// numNIC_AutoFallback is the count used with `num_nic = "auto"` for NICs whose resources are unknown
+const numNIC_AutoFallback = 10
+
+// parseNumNIC parses the `num_nic` setting, a count or "auto", returning the count, or
+// fallback count, and whether it is derived from each NIC's resources
+func parseNumNIC(value string) (count int, auto bool, err error) {
+	if value == numNIC_Auto {
+		return numNIC_AutoFallback, true, nil
+	}
+	count, err = strconv.Atoi(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("num_nic: must be a number or %q, got %q", numNIC_Auto, value)
+	}
+	return count, false, nil
+}
+
+// resolveNumNIC sets NumPsuedoNIC and NumPsuedoNICAuto per the `num_nic` and `num_nic_auto`
+// settings.  An invalid `num_nic` is left unresolved, for validateRuntimeSettings to report.
+func (c *OnloadDevicePluginConfig) resolveNumNIC() {
+	count, auto, err := parseNumNIC(c.NumNICSetting)
+	if err != nil {
+		return
+	}
+	c.NumPsuedoNIC = count
+	c.NumPsuedoNICAuto = auto || c.NumNICAutoSetting
+}
+
+// parseConfigDuration parses the duration setting name, appending any error to errs.
+// Negative durations are errors, as are zero ones unless allowZero.
+func parseConfigDuration(errs *[]error, name string, value string, allowZero bool) time.Duration {
+	duration, err := time.ParseDuration(value)
+	switch {
+	case err != nil:
+		*errs = append(*errs, fmt.Errorf("%s: failed to parse %q: %v", name, value, err))
+	case duration < 0:
+		*errs = append(*errs, fmt.Errorf("%s: must not be negative, got %q", name, value))
+	case duration == 0 && !allowZero:
+		*errs = append(*errs, fmt.Errorf("%s: must be positive, got %q", name, value))
+	}
+	return duration
+}
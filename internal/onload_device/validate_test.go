@@ -0,0 +1,209 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/base"
+)
+
+// validTestConfig returns the default config, with its Host paths in a temporary directory
+func validTestConfig(t *testing.T) OnloadDevicePluginConfig {
+	t.Helper()
+	config := parseTestConfig(t, `config {}`)
+	config.resolveNumNIC()
+	hostDir := t.TempDir()
+	config.HostOnloadLibPath = hostDir
+	config.HostOnloadBinPath = hostDir
+	config.HostProfileDirPath = hostDir
+	config.HostZfBinPath = hostDir
+	config.HostZfLibPath = hostDir
+	return config
+}
+
+func TestValidate(t *testing.T) {
+	const defaultProfileDir = "/usr/libexec/onload/profiles"
+	tests := []struct {
+		name         string
+		modify       func(c *OnloadDevicePluginConfig)
+		wantErrs     []string // substrings of each error, in order
+		wantWarnings []string // substrings of each warning, in order
+		skipIfExists string   // skip the test if this path exists
+	}{
+		{
+			name:   "valid",
+			modify: func(c *OnloadDevicePluginConfig) {},
+		},
+		{
+			// every problem is reported, naming its setting
+			name: "aggregated errors",
+			modify: func(c *OnloadDevicePluginConfig) {
+				c.NumNICSetting = "-1"
+				c.resolveNumNIC()
+				c.DeviceIDSource = "serial"
+				c.TaskPrefix = "/"
+				c.PreloadPolicy = "first"
+			},
+			wantErrs: []string{
+				"num_nic: must not be negative",
+				`device_id_source: unknown "serial"`,
+				"task_prefix: must not be '/'",
+				`preload_policy: unknown "first"`,
+			},
+		},
+		{
+			name:     "invalid num_nic",
+			modify:   func(c *OnloadDevicePluginConfig) { c.NumNICSetting = "many" },
+			wantErrs: []string{`num_nic: must be a number or "auto", got "many"`},
+		},
+		{
+			// Onload may be installed later, so a missing default Host path is only a warning
+			name:         "missing default host path",
+			modify:       func(c *OnloadDevicePluginConfig) { c.HostProfileDirPath = defaultProfileDir },
+			wantWarnings: []string{"host_profile_dir_path: default '" + defaultProfileDir + "' not found"},
+			skipIfExists: defaultProfileDir,
+		},
+		{
+			name: "missing configured host path",
+			modify: func(c *OnloadDevicePluginConfig) {
+				c.HostOnloadLibPath = filepath.Join(c.HostOnloadLibPath, "missing")
+			},
+			wantErrs: []string{"not found, set it to \"\" to disable it"},
+		},
+		{
+			name: "host path is a file",
+			modify: func(c *OnloadDevicePluginConfig) {
+				file := filepath.Join(c.HostOnloadBinPath, "onload")
+				if err := os.WriteFile(file, nil, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				c.HostOnloadBinPath = file
+			},
+			wantErrs: []string{"/onload' is not a directory"},
+		},
+		{
+			name: "relative paths",
+			modify: func(c *OnloadDevicePluginConfig) {
+				c.TaskOnloadLibPath = "usr/lib"
+				c.HostZfLibPath = "lib"
+				c.LedgerPath = "ledger.json"
+			},
+			wantErrs: []string{
+				"task_onload_lib_path: must be an absolute path",
+				"host_zf_lib_path: must be an absolute path",
+				"ledger_path: must be an absolute path",
+			},
+		},
+		{
+			name: "auto host paths",
+			modify: func(c *OnloadDevicePluginConfig) {
+				c.HostOnloadLibPath = hostPath_Auto
+				c.HostDevicePath = hostPath_Auto
+			},
+			wantErrs: []string{"host_device_path: must be an absolute path, got 'auto'"},
+		},
+		{
+			// a Task path needs its Host path, while a Host path without its Task path is not mounted
+			name: "task and host path pairs",
+			modify: func(c *OnloadDevicePluginConfig) {
+				c.HostZfLibPath = ""
+				c.TaskZfBinPath = ""
+			},
+			wantErrs:     []string{"task_zf_lib_path: is set, but host_zf_lib_path is empty"},
+			wantWarnings: []string{"host_zf_bin_path is set, but task_zf_bin_path is empty, so it is not mounted"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.skipIfExists != "" {
+				if _, err := os.Stat(tt.skipIfExists); err == nil {
+					t.Skipf("%s exists", tt.skipIfExists)
+				}
+			}
+			config := validTestConfig(t)
+			tt.modify(&config)
+			warnings, errs := config.validate()
+			if len(errs) != len(tt.wantErrs) {
+				t.Fatalf("errors = %v, want %d", errs, len(tt.wantErrs))
+			}
+			for i, want := range tt.wantErrs {
+				if !strings.Contains(errs[i].Error(), want) {
+					t.Errorf("error %d = %v, want it to contain %q", i, errs[i], want)
+				}
+			}
+			if len(warnings) != len(tt.wantWarnings) {
+				t.Fatalf("warnings = %q, want %d", warnings, len(tt.wantWarnings))
+			}
+			for i, want := range tt.wantWarnings {
+				if !strings.Contains(warnings[i], want) {
+					t.Errorf("warning %d = %q, want it to contain %q", i, warnings[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigDuration(t *testing.T) {
+	tests := []struct {
+		value     string
+		allowZero bool
+		wantErr   string
+	}{
+		{value: "1m"},
+		{value: "0s", allowZero: true},
+		{value: "0s", wantErr: "ledger_ttl: must be positive"},
+		{value: "-1s", allowZero: true, wantErr: "ledger_ttl: must not be negative"},
+		{value: "soon", wantErr: `ledger_ttl: failed to parse "soon"`},
+		{value: "", wantErr: `ledger_ttl: failed to parse ""`},
+	}
+	for _, tt := range tests {
+		var errs []error
+		parseConfigDuration(&errs, "ledger_ttl", tt.value, tt.allowZero)
+		switch {
+		case tt.wantErr == "" && len(errs) != 0:
+			t.Errorf("parseConfigDuration(%q, %v) errors = %v, want none", tt.value, tt.allowZero, errs)
+		case tt.wantErr != "" && (len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.wantErr)):
+			t.Errorf("parseConfigDuration(%q, %v) errors = %v, want %q", tt.value, tt.allowZero, errs, tt.wantErr)
+		}
+	}
+}
+
+func TestSetConfigInvalid(t *testing.T) {
+	config := validTestConfig(t)
+	config.NumNICSetting = "-1"
+	config.FingerprintPeriod = "0s"
+	config.LedgerTTL = "a day"
+	config.ProbeBackoff = "10s"
+	config.ProbeBackoffMax = "1s"
+	var pluginConfig []byte
+	if err := base.MsgPackEncode(&pluginConfig, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	// the config and its durations are validated together, reporting every problem
+	d := NewOnloadDevicePlugin(log.NewNullLogger())
+	initial := d.getConfig()
+	err := d.SetConfig(&base.Config{PluginConfig: pluginConfig})
+	if err == nil {
+		t.Fatal("SetConfig accepted an invalid config")
+	}
+	for _, want := range []string{
+		"num_nic: must not be negative",
+		"fingerprint_period: must be positive",
+		`ledger_ttl: failed to parse "a day"`,
+		"probe_backoff_max: must be at least probe_backoff",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want it to contain %q", err, want)
+		}
+	}
+	if d.getConfig() != initial {
+		t.Error("SetConfig set an invalid config")
+	}
+}
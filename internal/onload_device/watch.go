@@ -0,0 +1,66 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"context"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/hashicorp/go-hclog"
+)
+
+// watchRetryPeriod is how often watchPath retries watching a path that does not exist yet.
+// It is a variable so that tests may shorten it.
+var watchRetryPeriod = 10 * time.Second
+
+// watchPath calls onChange with the name of the changed file whenever the file or directory
+// at path changes, until ctx is done.  If the path cannot be watched, such as when it does
+// not exist yet, watching is retried every watchRetryPeriod, calling onChange with an empty
+// name once it succeeds, as anything may have changed.
+func watchPath(ctx context.Context, logger log.Logger, path string, onChange func(name string)) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("failed to create watcher", "path", path, "error", err)
+		return
+	}
+	defer watcher.Close()
+
+	retrying := false // whether watching is being retried, so changes may have been missed
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-retry.C:
+			if err := watcher.Add(path); err != nil {
+				logger.Debug("unable to watch path, retrying", "path", path, "error", err)
+				retrying = true
+				retry.Reset(watchRetryPeriod)
+				continue
+			}
+			if retrying {
+				retrying = false
+				onChange("") // it may have changed while not watched
+			}
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			logger.Trace("watched path changed", "path", path, "event", event.String())
+			if event.Name == path && event.Has(fsnotify.Remove|fsnotify.Rename) {
+				// the path itself is gone, so watch for its return
+				retrying = true
+				retry.Reset(watchRetryPeriod)
+			}
+			onChange(event.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn("watcher error", "path", path, "error", err)
+		}
+	}
+}
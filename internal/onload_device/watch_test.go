@@ -0,0 +1,65 @@
+// nomad-onload
+// Copyright (c) 2024 Neomantra BV
+
+package onload_device
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+func TestWatchPathRetry(t *testing.T) {
+	defer func(period time.Duration) { watchRetryPeriod = period }(watchRetryPeriod)
+	watchRetryPeriod = 10 * time.Millisecond
+
+	drainDir := filepath.Join(t.TempDir(), "drain")
+	changes := make(chan string, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchPath(ctx, log.NewNullLogger(), drainDir, func(name string) { changes <- name })
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the drain directory does not exist yet, so watching is retried until it does,
+	// then reported as an unnamed change
+	time.Sleep(5 * watchRetryPeriod)
+	if err := DrainInterface(drainDir, "eth0", ""); err != nil {
+		t.Fatal(err)
+	}
+	if name := waitForChange(t, changes); name != "" {
+		t.Errorf("first change = %q, want an unnamed change", name)
+	}
+
+	// once watched, changes within it are named
+	if err := os.WriteFile(filepath.Join(drainDir, "eth1"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(drainDir, "eth1")
+	for {
+		if name := waitForChange(t, changes); name == want {
+			break
+		}
+	}
+}
+
+// waitForChange returns the next change reported by watchPath, failing if there is none
+func waitForChange(t *testing.T, changes <-chan string) string {
+	t.Helper()
+	select {
+	case name := <-changes:
+		return name
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a change")
+		return ""
+	}
+}